@@ -2,44 +2,208 @@ package imagecache
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/h2non/bimg"
 )
 
 // Cache caches items
 type Cache struct {
-	store  Storer
-	layers []*Layer
+	store       Storer
+	layers      []*Layer
+	flights     *flightGroup
+	presets     map[string]*variant
+	presetsLock sync.RWMutex
+	sources     *sourceIndex
+	// negative remembers originals that do not exist
+	negative    *expiringCache[struct{}]
+	versions    *expiringCache[SourceVersion]
+	generations *generations
+	writeBack   *writeBack
+	wbConfig    WriteBackConfig
+	keyFunc     KeyFunc
+
+	lifecycle        sync.RWMutex
+	closed           bool
+	active           sync.WaitGroup
+	background       sync.WaitGroup
+	started          bool
+	stopBackground   context.CancelFunc
+	evictionInterval time.Duration
+	snapshotDir      string
+	snapshotInterval time.Duration
+	// loaded reports for each layer if its snapshot was loaded by Start, only
+	// those are saved again
+	loaded []bool
+}
+
+// LayerError is an error that occurred in a single [Layer] of a [Cache].
+type LayerError struct {
+	// Layer is the index of the layer as passed to [New].
+	Layer int
+	// Name of the item the operation failed for, if any.
+	Name string
+	Err  error
 }
 
+func (e *LayerError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("layer %d: %s", e.Layer, e.Err)
+	}
+	return fmt.Sprintf("layer %d: %s: %s", e.Layer, e.Name, e.Err)
+}
+
+func (e *LayerError) Unwrap() error {
+	return e.Err
+}
+
+// errSourceNotFound is used internally when the original image does not
+// exist in the [Storer].
+var errSourceNotFound = errors.New("source image not found")
+
+// ErrReadOnlyStore is returned when storing an original in a [Storer] that
+// can't be written to.
+var ErrReadOnlyStore = errors.New("store is read-only")
+
 // Creates a new Cache. Items are taken from the [Storer]. Items are removed
-// from the cache when certain criteria from each [Layer] are hit.
+// from the cache when certain criteria from each [Layer] are hit. Variants
+// are written to the layers in the background, call [Cache.Close] to stop
+// the writers once the Cache is no longer used.
 func New(store Storer, layers ...*Layer) *Cache {
-	return &Cache{
-		store:  store,
-		layers: layers,
+	return NewWithOptions(store, layers)
+}
+
+// NewWithOptions creates a new Cache like [New] and applies options to it.
+func NewWithOptions(store Storer, layers []*Layer, options ...Option) *Cache {
+	c := &Cache{
+		store:       store,
+		layers:      layers,
+		flights:     newFlightGroup(),
+		presets:     make(map[string]*variant),
+		sources:     newSourceIndex(),
+		generations: newGenerations(),
+		versions:    newExpiringCache[SourceVersion](DefaultVersionCheckInterval, defaultVersionEntries),
+		wbConfig:    DefaultWriteBackConfig(),
+		keyFunc:     CanonicalKey,
+	}
+	for _, option := range options {
+		option(c)
 	}
+	c.writeBack = newWriteBack(c.layers, c.wbConfig, c.evicted)
+	for _, l := range c.layers {
+		l.setOnEvict(c.evicted)
+		l.setOnRestore(c.restored)
+	}
+	return c
 }
 
-func (c *Cache) putInCache(ctx context.Context, name string, content []byte, above int) {
-	if above <= 0 {
-		above = len(c.layers)
+// restored is called when a layer restored the variant cacheName, e.g.
+// after a restart, so it can be found by [Cache.ClearSource].
+func (c *Cache) restored(cacheName string) {
+	if key, err := ParseKey(cacheName); err == nil {
+		c.sources.add(key.Source, cacheName)
+	}
+}
+
+// evicted is called when a layer evicted the variant cacheName, or when it
+// was not written to the layers. Variants that are in none of the layers
+// anymore are forgotten.
+func (c *Cache) evicted(cacheName string) {
+	for _, l := range c.layers {
+		if l.tracks(cacheName) {
+			return
+		}
+	}
+	c.forgetVariant(cacheName)
+}
+
+// forgetVariant removes everything known about the variant cacheName.
+func (c *Cache) forgetVariant(cacheName string) {
+	c.sources.remove(cacheName)
+	if key, err := ParseKey(cacheName); err == nil {
+		name := key.Source
+		key.Source, key.Version = "", ""
+		c.generations.drop(key.String(), name, cacheName)
+	}
+}
+
+// Store puts an original into the [Storer], if it supports it, and removes
+// all variants of the previous original from the cache. Returns
+// [ErrReadOnlyStore] if the [Storer] does not support writing.
+func (c *Cache) Store(ctx context.Context, name string, content []byte) error {
+	store, ok := c.store.(interface {
+		Put(ctx context.Context, name string, content []byte) error
+	})
+	if !ok {
+		return ErrReadOnlyStore
 	}
-	for i := 0; i < above; i++ {
-		c.layers[i].Put(ctx, name, content) //nolint:errcheck
+	if err := store.Put(ctx, name, content); err != nil {
+		return err
 	}
+	return c.ClearSource(ctx, name)
+}
+
+// putInCache queues entry to be written to all layers above the given
+// index, or to all layers if above is not positive.
+func (c *Cache) putInCache(ctx context.Context, name string, entry Entry, above int) {
+	if above <= 0 || above > len(c.layers) {
+		above = len(c.layers)
+	}
+	c.writeBack.enqueue(ctx, writeJob{
+		name:  name,
+		entry: entry,
+		above: above,
+	})
+}
+
+// WriteBackStats returns information about the writes of variants to the
+// layers.
+func (c *Cache) WriteBackStats() WriteBackStats {
+	return c.writeBack.stats()
 }
 
 // Clear a single item from the cache. There is no feedback on how successful the
 // operation was and which layer produced an error.
 func (c *Cache) Clear(ctx context.Context, name string) {
+	c.forgetVariant(name)
 	for _, l := range c.layers {
 		l.Delete(ctx, name) //nolint:errcheck
 	}
 }
 
+// ClearSource removes all variants of the original image name from all
+// layers, e.g. after the original has changed. Variants are known if they
+// were served since the Cache was created, or restored by the layers, see
+// [Layer.Rebuild] and [Layer.LoadSnapshot]. Errors of the layers are
+// reported as a joined error of [LayerError].
+func (c *Cache) ClearSource(ctx context.Context, name string) error {
+	c.negative.remove(name)
+	c.versions.remove(name)
+	c.generations.forget(name)
+	known := c.sources.take(name)
+	var errs []error
+	for i, l := range c.layers {
+		for _, cacheName := range known {
+			if !l.Exists(ctx, cacheName) {
+				continue
+			}
+			if err := l.Delete(ctx, cacheName); err != nil {
+				errs = append(errs, &LayerError{
+					Layer: i,
+					Name:  cacheName,
+					Err:   err,
+				})
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
 // EvictAll instructs all layers to check with all Evictionstrategies if files should be
 // evicted. Returns the number of evicted items.
 func (c *Cache) EvictAll(ctx context.Context) (count int) {
@@ -49,60 +213,257 @@ func (c *Cache) EvictAll(ctx context.Context) (count int) {
 	return
 }
 
-type Handler func(string, context.Context, http.ResponseWriter)
+// Handler serves the image name as a response to the request r. The context
+// of the request is used for all operations on the [Storer] and the layers.
+type Handler func(name string, w http.ResponseWriter, r *http.Request)
 
-func (c *Cache) Handle(imageType bimg.ImageType, config bimg.Options) (Handler, error) {
+// variant is a single combination of output type and transformation that
+// is served and cached.
+type variant struct {
+	imageType   bimg.ImageType
+	contentType string
+	config      bimg.Options
+	key         string
+	preset      string
+	maxAge      time.Duration
+	staleWindow time.Duration
+	ttl         time.Duration
+	stats       variantStats
+}
+
+// cacheKey returns the key of the variant for the original name, without
+// its version.
+func (v *variant) cacheKey(name string) Key {
+	return Key{
+		Type:           v.imageType,
+		Preset:         v.preset,
+		Transformation: v.key,
+		Source:         name,
+	}
+}
+
+// id identifies the variant independent of the original.
+func (v *variant) id() string {
+	return v.cacheKey("").String()
+}
+
+// variantStats counts how requests for a variant were answered.
+type variantStats struct {
+	hits   atomic.Uint64
+	misses atomic.Uint64
+	errors atomic.Uint64
+}
+
+func (c *Cache) newVariant(imageType bimg.ImageType, config bimg.Options) (*variant, error) {
 	contentType, ctOk := contentTypes[imageType]
 	if !SupportsType(imageType) || !ctOk {
 		return nil, fmt.Errorf("image type %s is not supported", bimg.ImageTypeName(imageType))
 	}
+	return &variant{
+		imageType:   imageType,
+		contentType: contentType,
+		config:      config,
+		key:         c.keyFunc(imageType, config),
+	}, nil
+}
+
+// Handle creates a [Handler] that serves images transformed by config and
+// converted to imageType. Responses carry a strong ETag, so clients can
+// revalidate them with conditional requests.
+func (c *Cache) Handle(imageType bimg.ImageType, config bimg.Options) (Handler, error) {
+	v, err := c.newVariant(imageType, config)
+	if err != nil {
+		return nil, err
+	}
+	return func(name string, w http.ResponseWriter, r *http.Request) {
+		c.serve(v, name, w, r)
+	}, nil
+}
+
+// HandleNegotiated creates a [Handler] that picks the output format from the
+// Accept header of each request. imageTypes are the candidates in the order
+// of preference, types that are not supported by the current installation of
+// libvips are skipped. Each negotiated type is cached on its own. If the
+// client accepts none of the candidates, the request is answered with
+// 406 Not Acceptable.
+func (c *Cache) HandleNegotiated(imageTypes []bimg.ImageType, config bimg.Options) (Handler, error) {
+	variants := make([]*variant, 0, len(imageTypes))
+	for _, t := range imageTypes {
+		v, err := c.newVariant(t, config)
+		if err != nil {
+			continue
+		}
+		variants = append(variants, v)
+	}
+	if len(variants) == 0 {
+		return nil, errors.New("none of the image types is supported")
+	}
+
+	return func(name string, w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		v := negotiate(r.Header.Get("Accept"), variants)
+		if v == nil {
+			notAcceptable(w)
+			return
+		}
+		c.serve(v, name, w, r)
+	}, nil
+}
 
-	cacheKey := fmt.Sprintf("%s-%s", bimg.ImageTypeName(imageType), cacheKey(config))
+// serve answers r with the variant v of the image name. The variant is
+// taken from the first layer that has it, otherwise it is created from the
+// original in the [Storer] and put into all layers.
+func (c *Cache) serve(v *variant, name string, w http.ResponseWriter, r *http.Request) {
+	if !c.acquire() {
+		serviceUnavailable(w)
+		return
+	}
+	defer c.active.Done()
 
-	return func(name string, ctx context.Context, w http.ResponseWriter) {
-		w.Header().Set("Content-Type", contentType)
+	ctx := r.Context()
+	if _, missing := c.negative.get(name); missing {
+		notFound(w)
+		return
+	}
+	w.Header().Set("Content-Type", v.contentType)
 
+	// the version of the original is part of the cache key, so changes of
+	// the original result in new variants
+	key := v.cacheKey(name)
+	var modTime time.Time
+	if version, ok := c.version(ctx, name); ok {
+		modTime = version.ModTime
+		key.Version = version.String()
+	}
+	cacheName := key.String()
+
+	gen, serveStale, refresh := c.stale(v, name, cacheName, modTime)
+	if serveStale && c.serveStale(v, name, key, gen, w, r) {
+		return
+	}
+
+	if !refresh {
 		// check if it is in one of the caches
-		cacheName := fmt.Sprintf("%s-%s", cacheKey, name)
-		for i, l := range c.layers {
-			if !l.Exists(ctx, cacheName) {
-				continue
+		if entry, layer, ok := c.lookup(ctx, name, cacheName); ok {
+			if gen.cacheName != cacheName && (v.maxAge > 0 || v.staleWindow > 0) {
+				// first access since restart
+				created := entry.Metadata.Created
+				if created.IsZero() {
+					created = time.Now()
+				}
+				c.generations.set(v.id(), name, cacheName, created)
 			}
+			v.stats.hits.Add(1)
+			writeEntry(w, r, cacheName, entry, modTime)
+			c.promote(ctx, cacheName, entry, layer)
+			return
+		}
+	}
+	v.stats.misses.Add(1)
 
-			content, err := l.Get(ctx, cacheName)
-			if i > 0 && err == nil {
-				// does not exist in higher up caches
-				go c.putInCache(ctx, cacheName, content, i)
-			}
-			if err == nil {
-				writeImage(w, content)
-				return
-			}
+	// not in cache, concurrent requests for the same variant share
+	// a single transformation
+	entry, err := c.create(ctx, v, key)
+	switch {
+	case err == nil:
+		writeEntry(w, r, cacheName, entry, modTime)
+	case errors.Is(err, errSourceNotFound):
+		notFound(w)
+	case ctx.Err() != nil:
+		// client is gone, nobody to answer to
+	default:
+		v.stats.errors.Add(1)
+		internalError(w)
+	}
+}
+
+// lookup returns the entry of cacheName and the index of the first layer
+// that has it.
+func (c *Cache) lookup(ctx context.Context, name, cacheName string) (Entry, int, bool) {
+	for i, l := range c.layers {
+		if !l.Exists(ctx, cacheName) {
+			continue
 		}
 
-		// not in cache
+		entry, err := l.GetEntry(ctx, cacheName)
+		if err != nil {
+			continue
+		}
+		c.sources.add(name, cacheName)
+		return entry, i, true
+	}
+	return Entry{}, 0, false
+}
 
+// promote populates the layers above the given index with entry, once it
+// was found in a lower layer by [Cache.lookup]. The write is queued in the
+// background, as it might have to wait for space in the write-back queue.
+// It counts as part of the request for [Cache.Close].
+func (c *Cache) promote(ctx context.Context, cacheName string, entry Entry, layer int) {
+	if layer <= 0 {
+		return
+	}
+	// does not exist in higher up caches
+	c.active.Add(1)
+	go func() {
+		defer c.active.Done()
+		c.putInCache(context.WithoutCancel(ctx), cacheName, entry, layer)
+	}()
+}
+
+// create returns the variant v of the original in key, shared with all
+// concurrent requests for it. The variant is put into all layers after it
+// was handed to the requests.
+func (c *Cache) create(ctx context.Context, v *variant, key Key) (Entry, error) {
+	cacheName := key.String()
+	return c.flights.Do(ctx, cacheName, c.transform(v, key), func(ctx context.Context, entry Entry) {
+		c.putInCache(ctx, cacheName, entry, -1)
+	})
+}
+
+// transform returns the function that creates the variant v of the original
+// in key.
+func (c *Cache) transform(v *variant, key Key) func(context.Context) (Entry, error) {
+	name, cacheName := key.Source, key.String()
+	return func(ctx context.Context) (Entry, error) {
 		// check if image exists
 		if !c.store.Exists(ctx, name) {
-			notFound(w)
-			return
+			c.negative.add(name, struct{}{})
+			return Entry{}, errSourceNotFound
 		}
 
 		content, err := c.store.Get(ctx, name)
 		if err != nil {
 			// it should be there
-			internalError(w)
-			return
+			return Entry{}, err
 		}
 
-		transformed, err := handleImage(content, config, imageType)
+		start := time.Now()
+		transformed, err := handleImage(content, v.config, v.imageType)
 		if err != nil {
-			internalError(w)
-			return
+			return Entry{}, err
+		}
+		entry := Entry{
+			Content: transformed,
+			Metadata: Metadata{
+				Created:       time.Now(),
+				SourceVersion: key.Version,
+				ContentType:   v.contentType,
+				Cost:          time.Since(start),
+			},
+		}
+		if v.ttl > 0 {
+			entry.Metadata.Expires = entry.Metadata.Created.Add(v.ttl)
+		}
+		if size, err := bimg.Size(transformed); err == nil {
+			entry.Metadata.Width = size.Width
+			entry.Metadata.Height = size.Height
 		}
-		// put in all caches
-		go c.putInCache(ctx, cacheName, transformed, -1)
 
-		writeImage(w, transformed)
-	}, nil
+		c.sources.add(name, cacheName)
+		if v.maxAge > 0 || v.staleWindow > 0 {
+			c.generations.set(v.id(), name, cacheName, entry.Metadata.Created)
+		}
+		return entry, nil
+	}
 }
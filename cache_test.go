@@ -0,0 +1,249 @@
+package imagecache
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/h2non/bimg"
+)
+
+// testImage returns a small PNG image.
+func testImage(t testing.TB) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// newTestCache creates a cache with a single layer over [Memory] and returns
+// it with its store.
+func newTestCache(t testing.TB, options ...Option) (*Cache, *Memory) {
+	store := NewMemory()
+	return NewWithOptions(store, []*Layer{NewLayer(NewMemory())}, options...), store
+}
+
+// testOptions is the transformation of the variants in tests.
+var testOptions = bimg.Options{Width: 4}
+
+// testVariant returns the JPEG variant of c served by tests.
+func testVariant(t testing.TB, c *Cache) *variant {
+	v, err := c.newVariant(bimg.JPEG, testOptions)
+	if err != nil {
+		t.Skip(err)
+	}
+	return v
+}
+
+// seed puts the original name into the store of c and content as its
+// variant v into the first layer, so requests are served without
+// transforming the original. Returns the name of the cached variant.
+func seed(t testing.TB, c *Cache, v *variant, name string, content []byte) string {
+	return seedEntry(t, c, v, name, Entry{Content: content})
+}
+
+// seedEntry is [seed] with metadata. A zero creation time is replaced by the
+// time the original was stored.
+func seedEntry(t testing.TB, c *Cache, v *variant, name string, entry Entry) string {
+	return seedLayer(t, c, 0, v, name, entry)
+}
+
+// seedLayer is [seedEntry] for the layer with index layer.
+func seedLayer(t testing.TB, c *Cache, layer int, v *variant, name string, entry Entry) string {
+	ctx := context.Background()
+	store := c.store.(interface {
+		Versioner
+		Put(ctx context.Context, name string, content []byte) error
+	})
+	if err := store.Put(ctx, name, testImage(t)); err != nil {
+		t.Fatal(err)
+	}
+	key := v.cacheKey(name)
+	version, err := store.Version(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.Version = version.String()
+	if entry.Metadata.Created.IsZero() {
+		entry.Metadata.Created = version.ModTime
+	}
+	entry.Metadata.ContentType = v.contentType
+	if err := c.layers[layer].PutEntry(ctx, key.String(), entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.layers[layer].Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return key.String()
+}
+
+// get requests name from h with the headers and returns the response.
+func get(h Handler, name string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/"+name, nil)
+	for key, values := range header {
+		r.Header[key] = values
+	}
+	w := httptest.NewRecorder()
+	h(name, w, r)
+	return w
+}
+
+func TestConditionalRequest(t *testing.T) {
+	c, _ := newTestCache(t)
+	h, err := c.Handle(bimg.JPEG, testOptions)
+	if err != nil {
+		t.Skip(err)
+	}
+	seed(t, c, testVariant(t, c), "cat.png", []byte("variant"))
+
+	w := get(h, "cat.png", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "variant" {
+		t.Fatalf("expected the variant, got %d %q", w.Code, w.Body)
+	}
+	etag, lastModified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatalf("expected ETag and Last-Modified, got %v", w.Header())
+	}
+
+	tests := []struct {
+		header http.Header
+		want   int
+	}{
+		{http.Header{"If-None-Match": {etag}}, http.StatusNotModified},
+		{http.Header{"If-None-Match": {`"other"`}}, http.StatusOK},
+		{http.Header{"If-Modified-Since": {lastModified}}, http.StatusNotModified},
+		// If-None-Match takes precedence
+		{http.Header{"If-None-Match": {`"other"`}, "If-Modified-Since": {lastModified}}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := get(h, "cat.png", tt.header)
+		if w.Code != tt.want {
+			t.Errorf("%v: expected %d, got %d", tt.header, tt.want, w.Code)
+		}
+		if w.Code == http.StatusNotModified && w.Body.Len() != 0 {
+			t.Errorf("%v: expected no body, got %q", tt.header, w.Body)
+		}
+	}
+}
+
+func TestClearSource(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestCache(t)
+	v := testVariant(t, c)
+	served := seed(t, c, v, "cat.png", []byte("served"))
+	get(func(name string, w http.ResponseWriter, r *http.Request) {
+		c.serve(v, name, w, r)
+	}, "cat.png", nil)
+
+	// cached before a restart, found by rebuilding the layer
+	key := v.cacheKey("cat.png")
+	key.Version = "old"
+	restored := key.String()
+	c.layers[0].cache.Put(ctx, restored, []byte("restored")) //nolint:errcheck
+	if err := c.layers[0].Rebuild(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// not a variant of cat.png
+	c.layers[0].cache.Put(ctx, "cat.png", []byte("other")) //nolint:errcheck
+	other := seed(t, c, v, "dog.png", []byte("other"))
+
+	if err := c.ClearSource(ctx, "cat.png"); err != nil {
+		t.Fatal(err)
+	}
+	for cacheName, keep := range map[string]bool{served: false, restored: false, other: true, "cat.png": true} {
+		if c.layers[0].Exists(ctx, cacheName) != keep {
+			t.Errorf("expected %s to exist: %t", cacheName, keep)
+		}
+	}
+}
+
+func TestClearSourceRebuiltBefore(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemory()
+	key := Key{Type: bimg.JPEG, Transformation: "t", Version: "old", Source: "cat.png"}
+	mem.Put(ctx, key.String(), []byte("restored")) //nolint:errcheck
+	l := NewLayer(mem)
+	if err := l.Rebuild(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New(NewMemory(), l)
+	if err := c.ClearSource(ctx, "cat.png"); err != nil {
+		t.Fatal(err)
+	}
+	if l.Exists(ctx, key.String()) {
+		t.Fatal("expected the restored variant to be removed")
+	}
+}
+
+func TestSourceIndexEviction(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemory()
+	c := New(store, NewLayer(NewMemory(), NewMaxItemsEviction(1)))
+	v := testVariant(t, c)
+	h := func(name string, w http.ResponseWriter, r *http.Request) {
+		c.serve(v, name, w, r)
+	}
+	first := seed(t, c, v, "cat.png", []byte("cat"))
+	get(h, "cat.png", nil)
+	seed(t, c, v, "dog.png", []byte("dog"))
+	c.layers[0].Wait(ctx) //nolint:errcheck
+
+	if c.layers[0].Exists(ctx, first) {
+		t.Fatal("expected first variant to be evicted")
+	}
+	if variants := c.sources.take("cat.png"); len(variants) != 0 {
+		t.Errorf("expected evicted variant to be forgotten, got %v", variants)
+	}
+}
+
+// countingStore counts the version lookups and reads of [Memory].
+type countingStore struct {
+	*Memory
+	lookups atomic.Int32
+	reads   atomic.Int32
+}
+
+func (cs *countingStore) Get(ctx context.Context, name string) ([]byte, error) {
+	cs.reads.Add(1)
+	return cs.Memory.Get(ctx, name)
+}
+
+func (cs *countingStore) Version(ctx context.Context, name string) (SourceVersion, error) {
+	cs.lookups.Add(1)
+	return cs.Memory.Version(ctx, name)
+}
+
+func TestVersionCheck(t *testing.T) {
+	tests := []struct {
+		options []Option
+		lookups int32
+	}{
+		{nil, 1},
+		{[]Option{WithVersionCheck(0, 0)}, 3},
+	}
+	for _, tt := range tests {
+		store := &countingStore{Memory: NewMemory()}
+		c := NewWithOptions(store, []*Layer{NewLayer(NewMemory())}, tt.options...)
+		v := testVariant(t, c)
+		h := func(name string, w http.ResponseWriter, r *http.Request) {
+			c.serve(v, name, w, r)
+		}
+		seed(t, c, v, "cat.png", []byte("cat"))
+		store.lookups.Store(0)
+		for i := 0; i < 3; i++ {
+			if w := get(h, "cat.png", nil); w.Body.String() != "cat" {
+				t.Fatalf("expected cached variant, got %d %q", w.Code, w.Body)
+			}
+		}
+		if lookups := store.lookups.Load(); lookups != tt.lookups {
+			t.Errorf("expected %d version lookups, got %d", tt.lookups, lookups)
+		}
+	}
+}
@@ -1,6 +1,10 @@
 package imagecache
 
-import "context"
+import (
+	"context"
+	"errors"
+	"time"
+)
 
 // Cacher is the interface [Cache] expects to cache transformed images to.
 type Cacher interface {
@@ -8,5 +12,28 @@ type Cacher interface {
 	Exists(ctx context.Context, name string) bool
 	Delete(ctx context.Context, name string) error
 	Get(ctx context.Context, name string) ([]byte, error)
-	// Stats() (count int32, size int64)
+}
+
+// ErrNotEnumerable is returned if the items of a [Cacher] can't be listed.
+var ErrNotEnumerable = errors.New("cache does not support listing its items")
+
+// StoredItem describes an item found in a [Cacher]. Name is empty for
+// content whose name is unknown, like files written by older versions. Such
+// content can't be read or deleted by name, but takes up space.
+type StoredItem struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	// Expires is [Metadata.Expires] of the item, if known.
+	Expires time.Time
+	// Cost is [Metadata.Cost] of the item, if known.
+	Cost time.Duration
+}
+
+// Enumerator is an optional interface of a [Cacher] that can list all of
+// its items.
+type Enumerator interface {
+	// Walk calls fn for every item. Walking stops at the first error
+	// returned by fn, which is returned.
+	Walk(ctx context.Context, fn func(StoredItem) error) error
 }
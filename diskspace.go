@@ -0,0 +1,44 @@
+package imagecache
+
+import "errors"
+
+// compile time check
+var _ EvictionStrategy = &DiskSpaceEviction{}
+
+// errDiskSpaceUnsupported is returned if the free space of a filesystem
+// can't be determined on the current platform.
+var errDiskSpaceUnsupported = errors.New("free disk space is not supported on this platform")
+
+// DiskSpaceEviction evicts items when the free space of the filesystem a
+// layer is stored on runs low, e.g. because the volume is shared with other
+// processes. Once the free space drops below a minimum, items are evicted
+// in the order of the layer until a target is free again. The gap between
+// both avoids evicting on every pass. If the free space can't be determined,
+// nothing is evicted.
+type DiskSpaceEviction struct {
+	path       string
+	minFree    int64
+	targetFree int64
+	// freeSpace returns the free bytes of the filesystem of a path
+	freeSpace func(path string) (int64, error)
+}
+
+// NewDiskSpaceEviction creates a new EvictionStrategy which evicts items when
+// less than minFree bytes are free on the filesystem of path, until
+// targetFree bytes are free. targetFree should be larger than minFree.
+func NewDiskSpaceEviction(path string, minFree, targetFree int64) *DiskSpaceEviction {
+	return &DiskSpaceEviction{
+		path:       path,
+		minFree:    minFree,
+		targetFree: max(minFree, targetFree),
+		freeSpace:  freeSpace,
+	}
+}
+
+func (dse *DiskSpaceEviction) Victims(view LayerView) []string {
+	free, err := dse.freeSpace(dse.path)
+	if err != nil || free >= dse.minFree {
+		return nil
+	}
+	return oldestVictims(view, dse.targetFree-free)
+}
@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd)
+
+package imagecache
+
+// freeSpace is not supported on this platform.
+func freeSpace(path string) (int64, error) {
+	return 0, errDiskSpaceUnsupported
+}
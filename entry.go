@@ -0,0 +1,68 @@
+package imagecache
+
+import (
+	"context"
+	"time"
+)
+
+// Metadata describes a cached variant. Fields are zero if unknown.
+type Metadata struct {
+	// Created is the time the variant was created.
+	Created time.Time
+	// SourceVersion is the version of the original the variant was created
+	// from, see [SourceVersion].
+	SourceVersion string
+	ContentType   string
+	Width         int
+	Height        int
+	// Expires is the time after which the variant is removed from the
+	// layers by a [TTLEviction], independent of its default ttl.
+	Expires time.Time
+	// Cost is the time it took to transform the original into the variant.
+	Cost time.Duration
+}
+
+// Entry is the content of a cached variant with its metadata.
+type Entry struct {
+	Content  []byte
+	Metadata Metadata
+}
+
+// EntryCacher is an optional interface of a [Cacher] that is able to store
+// metadata alongside the content.
+type EntryCacher interface {
+	Cacher
+	PutEntry(ctx context.Context, name string, entry Entry) error
+	GetEntry(ctx context.Context, name string) (Entry, error)
+}
+
+// Entries returns c as an [EntryCacher]. If c does not implement it, the
+// returned adapter drops metadata on put and returns empty metadata on get.
+func Entries(c Cacher) EntryCacher {
+	if ec, ok := c.(EntryCacher); ok {
+		return ec
+	}
+	return &plainEntries{
+		Cacher: c,
+	}
+}
+
+// plainEntries adapts a [Cacher] without metadata support to an
+// [EntryCacher].
+type plainEntries struct {
+	Cacher
+}
+
+func (pe *plainEntries) PutEntry(ctx context.Context, name string, entry Entry) error {
+	return pe.Put(ctx, name, entry.Content)
+}
+
+func (pe *plainEntries) GetEntry(ctx context.Context, name string) (Entry, error) {
+	content, err := pe.Get(ctx, name)
+	if err != nil {
+		return Entry{}, err
+	}
+	return Entry{
+		Content: content,
+	}, nil
+}
@@ -14,8 +14,12 @@ const (
 	GB = MB * 1024
 )
 
+// EvictionStrategy decides which items are evicted from a [Layer].
 type EvictionStrategy interface {
-	check(c *Layer) bool
+	// Victims nominates the names of the items that should be evicted.
+	// The layer is locked while Victims is called, so it must not call
+	// methods of the [Layer] and should return quickly.
+	Victims(view LayerView) []string
 }
 
 // compile time checks
@@ -36,52 +40,72 @@ func NewLastAccessEviction(duration time.Duration) *LastAccessEviction {
 	}
 }
 
-func (lae *LastAccessEviction) check(c *Layer) bool {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
-	last := c.access.Back()
-	if last != nil {
-		return time.Since(c.access.Back().Value.lastAccess) > lae.dur
-	}
-	// cache is empty
-	return false
+func (lae *LastAccessEviction) Victims(view LayerView) (victims []string) {
+	view.RangeLastAccess(func(i ItemInfo) bool {
+		if time.Since(i.LastAccess) <= lae.dur {
+			return false
+		}
+		victims = append(victims, i.Name)
+		return true
+	})
+	return
 }
 
 // MaxCacheSizeEviction evict items when a certain size is reached. Items
-// are evicted in the order of their last access.
+// are evicted in the order of the [ReplacementPolicy] of the layer.
 type MaxCacheSizeEviction struct {
 	maxSize int64
 }
 
 // NewMaxCacheSizeEviction creates a new EvictionStrategy which evicts items
-// by their last access when a certain size is reached.
+// when a certain size is reached.
 func NewMaxCacheSizeEviction(size int64) *MaxCacheSizeEviction {
 	return &MaxCacheSizeEviction{
 		maxSize: size,
 	}
 }
 
-func (mse *MaxCacheSizeEviction) check(c *Layer) bool {
-	size := c.size.Load()
-	return size > mse.maxSize
+func (mse *MaxCacheSizeEviction) Victims(view LayerView) []string {
+	return oldestVictims(view, view.Size()-mse.maxSize)
 }
 
 // MaxItemsEviction evict items when a certain number of items is reached.
-// Items are evicted in the order of their last access.
+// Items are evicted in the order of the [ReplacementPolicy] of the layer.
 type MaxItemsEviction struct {
 	n int
 }
 
 // NewMaxItemsEviction create a new EvictionStrategy which evicts items
-// when a certain number of items are in the layer. Items are evicted in the
-// order by their last access.
+// when a certain number of items are in the layer.
 func NewMaxItemsEviction(number int) *MaxItemsEviction {
 	return &MaxItemsEviction{
 		n: number,
 	}
 }
 
-func (mie *MaxItemsEviction) check(c *Layer) bool {
-	count := c.count.Load()
-	return count > int32(mie.n)
+func (mie *MaxItemsEviction) Victims(view LayerView) (victims []string) {
+	excess := int(view.Count()) - mie.n
+	if excess <= 0 {
+		return nil
+	}
+	view.Range(func(i ItemInfo) bool {
+		victims = append(victims, i.Name)
+		return len(victims) < excess
+	})
+	return
+}
+
+// oldestVictims nominates items in the order of the layer until at least
+// bytes are freed.
+func oldestVictims(view LayerView, bytes int64) (victims []string) {
+	if bytes <= 0 {
+		return nil
+	}
+	var freed int64
+	view.Range(func(i ItemInfo) bool {
+		victims = append(victims, i.Name)
+		freed += i.Size
+		return freed < bytes
+	})
+	return
 }
@@ -0,0 +1,420 @@
+package imagecache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fill puts n items of size bytes into l and waits for the bookkeeping.
+func fill(t testing.TB, l *Layer, n int, size int) {
+	ctx := context.Background()
+	for i := 0; i < n; i++ {
+		if err := l.Put(ctx, fmt.Sprintf("item-%d", i), make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMaxItemsEviction(t *testing.T) {
+	l := NewLayer(NewMemory(), NewMaxItemsEviction(3))
+	fill(t, l, 5, 1)
+	if count := l.Stats().Count; count != 3 {
+		t.Fatalf("expected 3 items, got %d", count)
+	}
+	for _, name := range []string{"item-0", "item-1"} {
+		if l.Exists(context.Background(), name) {
+			t.Errorf("expected %s to be evicted", name)
+		}
+	}
+}
+
+func TestMaxCacheSizeEviction(t *testing.T) {
+	l := NewLayer(NewMemory(), NewMaxCacheSizeEviction(25))
+	fill(t, l, 5, 10)
+	if stats := l.Stats(); stats.Count != 2 || stats.Size != 20 {
+		t.Fatalf("expected 2 items with 20 bytes, got %+v", stats)
+	}
+}
+
+func TestLFUEviction(t *testing.T) {
+	ctx := context.Background()
+	l := NewLayer(NewMemory(), NewLFUEviction(3, 0, 0))
+	fill(t, l, 3, 1)
+	// item-0 is the least recently, but most frequently used
+	for i := 0; i < 3; i++ {
+		l.Get(ctx, "item-0") //nolint:errcheck
+		l.Wait(ctx)          //nolint:errcheck
+	}
+	l.Put(ctx, "new", []byte{1}) //nolint:errcheck
+	l.Wait(ctx)                  //nolint:errcheck
+
+	if !l.Exists(ctx, "item-0") {
+		t.Error("expected frequently used item to stay")
+	}
+	if l.Exists(ctx, "item-1") {
+		t.Error("expected item-1 to be evicted")
+	}
+}
+
+func TestTinyLFUAdmission(t *testing.T) {
+	ctx := context.Background()
+	l := NewLayer(NewMemory(), NewTinyLFUEviction(3, 0))
+	fill(t, l, 3, 1)
+	for i := 0; i < 3; i++ {
+		l.Get(ctx, "item-0") //nolint:errcheck
+	}
+
+	// a one-off item does not replace anything
+	l.Put(ctx, "scan", []byte{1}) //nolint:errcheck
+	l.Wait(ctx)                   //nolint:errcheck
+	if l.Exists(ctx, "scan") {
+		t.Error("expected one-off item not to be admitted")
+	}
+
+	// a repeatedly requested one does
+	for i := 0; i < 3; i++ {
+		l.Put(ctx, "popular", []byte{1}) //nolint:errcheck
+		l.Wait(ctx)                      //nolint:errcheck
+	}
+	if !l.Exists(ctx, "popular") {
+		t.Error("expected popular item to be admitted")
+	}
+	if count := l.Stats().Count; count != 3 {
+		t.Errorf("expected 3 items, got %d", count)
+	}
+}
+
+func TestARCPolicy(t *testing.T) {
+	ctx := context.Background()
+	l := NewLayerWithPolicy(NewMemory(), NewARCPolicy(3), NewMaxItemsEviction(3))
+	fill(t, l, 3, 1)
+	l.Get(ctx, "item-0") //nolint:errcheck
+	l.Wait(ctx)          //nolint:errcheck
+
+	// a scan over new items does not replace the item used twice
+	for i := 0; i < 3; i++ {
+		l.Put(ctx, fmt.Sprintf("scan-%d", i), []byte{1}) //nolint:errcheck
+		l.Wait(ctx)                                      //nolint:errcheck
+	}
+	if !l.Exists(ctx, "item-0") {
+		t.Error("expected frequently used item to stay")
+	}
+	if count := l.Stats().Count; count != 3 {
+		t.Errorf("expected 3 items, got %d", count)
+	}
+}
+
+func TestARCPolicyRemove(t *testing.T) {
+	arc := NewARCPolicy(2)
+	arc.Touch("deleted")
+	arc.Touch("evicted")
+
+	// deleted items are not remembered
+	arc.Remove("deleted")
+	arc.Touch("deleted")
+	if e := arc.entries["deleted"]; e.list != arcT1 || arc.p != 0 {
+		t.Fatalf("expected deleted item to be new, got list %d with p %d", e.list, arc.p)
+	}
+
+	arc.Evict("evicted")
+	if e := arc.entries["evicted"]; e.list != arcB1 {
+		t.Fatalf("expected evicted item in a ghost list, got list %d", e.list)
+	}
+	arc.Touch("evicted")
+	if e := arc.entries["evicted"]; e.list != arcT2 || arc.p != 1 {
+		t.Fatalf("expected ghost hit, got list %d with p %d", e.list, arc.p)
+	}
+}
+
+func TestLastAccessEviction(t *testing.T) {
+	lae := NewLastAccessEviction(time.Minute)
+	old := time.Now().Add(-time.Hour)
+	for _, policy := range []ReplacementPolicy{NewLRUPolicy(), NewARCPolicy(3)} {
+		l := NewLayerWithPolicy(NewMemory(), policy)
+		fill(t, l, 3, 1)
+		// accessed long ago, out of the order of the policy
+		for _, name := range []string{"item-2", "item-0"} {
+			i := l.inventory[name]
+			i.lastAccess = old
+			l.byLastAccess.fix(i)
+		}
+		victims := lae.Victims(layerView{l: l})
+		slices.Sort(victims)
+		if !slices.Equal(victims, []string{"item-0", "item-2"}) {
+			t.Errorf("%T: expected item-0 and item-2 to be evicted, got %v", policy, victims)
+		}
+	}
+}
+
+func TestTTLEviction(t *testing.T) {
+	ctx := context.Background()
+	l := NewLayer(NewMemory(), NewTTLEviction(time.Hour))
+	now := time.Now()
+	entries := map[string]Metadata{
+		"old":     {Created: now.Add(-2 * time.Hour)},
+		"fresh":   {},
+		"expired": {Created: now, Expires: now.Add(-time.Second)},
+		"long":    {Created: now.Add(-2 * time.Hour), Expires: now.Add(time.Hour)},
+	}
+	for name, metadata := range entries {
+		l.PutEntry(ctx, name, Entry{Content: []byte{1}, Metadata: metadata}) //nolint:errcheck
+		l.Wait(ctx)                                                          //nolint:errcheck
+	}
+	// accesses do not extend the lifetime
+	l.Get(ctx, "old") //nolint:errcheck
+	l.Wait(ctx)       //nolint:errcheck
+	l.Evict(ctx)
+
+	for name, keep := range map[string]bool{"old": false, "fresh": true, "expired": false, "long": true} {
+		if l.Exists(ctx, name) != keep {
+			t.Errorf("expected %s to exist: %t", name, keep)
+		}
+	}
+}
+
+func TestGDSFEviction(t *testing.T) {
+	ctx := context.Background()
+	l := NewLayer(NewMemory(), NewGDSFEviction(0, 115))
+	entries := []struct {
+		name string
+		size int
+		cost time.Duration
+	}{
+		{"thumb", 10, time.Second},
+		{"hero", 100, time.Second},
+		{"cheap", 10, time.Millisecond},
+	}
+	for _, e := range entries {
+		entry := Entry{Content: make([]byte, e.size), Metadata: Metadata{Cost: e.cost}}
+		l.PutEntry(ctx, e.name, entry) //nolint:errcheck
+		l.Wait(ctx)                    //nolint:errcheck
+	}
+
+	// cheap is the most recently used item, but the cheapest to create again
+	for name, keep := range map[string]bool{"thumb": true, "hero": true, "cheap": false} {
+		if l.Exists(ctx, name) != keep {
+			t.Errorf("expected %s to exist: %t", name, keep)
+		}
+	}
+}
+
+func TestDiskSpaceEviction(t *testing.T) {
+	ctx := context.Background()
+	dse := NewDiskSpaceEviction("cache", 30, 60)
+	l := NewLayer(NewMemory(), dse)
+	// a disk of 100 bytes, used only by the layer
+	dse.freeSpace = func(path string) (int64, error) {
+		if path != "cache" {
+			t.Errorf("unexpected path %s", path)
+		}
+		return 100 - l.size.Load(), nil
+	}
+	put := func(prefix string, n int, expected int32) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			l.Put(ctx, fmt.Sprintf("%s-%d", prefix, i), make([]byte, 10)) //nolint:errcheck
+			l.Wait(ctx)                                                   //nolint:errcheck
+		}
+		if count := l.Stats().Count; count != expected {
+			t.Fatalf("expected %d items, got %d", expected, count)
+		}
+	}
+
+	// exactly the minimum is free
+	put("a", 7, 7)
+	// below the minimum, evict until the target is free
+	put("b", 1, 4)
+	if l.Exists(ctx, "a-3") || !l.Exists(ctx, "a-4") {
+		t.Fatal("expected the least recently used items to be evicted")
+	}
+	// no eviction until the free space drops below the minimum again
+	put("c", 3, 7)
+	put("d", 1, 4)
+
+	dse.freeSpace = func(string) (int64, error) {
+		return 0, errDiskSpaceUnsupported
+	}
+	put("e", 3, 7)
+}
+
+func TestMemoryPressureEviction(t *testing.T) {
+	ctx := context.Background()
+	var memory int64
+	var cycle uint64
+	newLayer := func(high, low float64) *Layer {
+		mpe := NewMemoryPressureEviction(100, high, low)
+		mpe.measure = func() (int64, uint64, bool) {
+			return memory, cycle, true
+		}
+		l := NewLayer(NewMemory(), mpe)
+		for i := 0; i < 10; i++ {
+			l.cache.Put(ctx, fmt.Sprintf("item-%d", i), make([]byte, 10)) //nolint:errcheck
+			l.accessed(fmt.Sprintf("item-%d", i), 10, Metadata{}, true)
+		}
+		return l
+	}
+	evict := func(l *Layer, used int64, expected int) {
+		t.Helper()
+		memory = used
+		if count := l.Evict(ctx); count != expected {
+			t.Fatalf("expected %d evicted items at %d bytes, got %d", expected, used, count)
+		}
+	}
+
+	l := newLayer(0.9, 0.5)
+	evict(l, 90, 0)
+	// above the high watermark, evict until below the low one
+	evict(l, 95, 5)
+	// evicted items are not freed before the next garbage collection
+	evict(l, 95, 0)
+	cycle++
+	evict(l, 60, 0)
+	evict(l, 95, 5)
+
+	// invalid watermarks evict at the limit
+	for _, watermarks := range [][2]float64{{0, 0}, {-1, -1}, {2, 2}} {
+		l = newLayer(watermarks[0], watermarks[1])
+		evict(l, 100, 0)
+		cycle++
+		evict(l, 101, 1)
+	}
+}
+
+// undeletableCacher is [Memory] with deletes that fail while fail is set.
+type undeletableCacher struct {
+	*Memory
+	fail bool
+}
+
+func (uc *undeletableCacher) Delete(ctx context.Context, name string) error {
+	if uc.fail {
+		return errors.New("read-only")
+	}
+	return uc.Memory.Delete(ctx, name)
+}
+
+func TestMemoryPressureEvictionShed(t *testing.T) {
+	ctx := context.Background()
+	mpe := NewMemoryPressureEviction(100, 0.9, 0.5)
+	mpe.measure = func() (int64, uint64, bool) {
+		return 95, 0, true
+	}
+	uc := &undeletableCacher{Memory: NewMemory(), fail: true}
+	l := NewLayer(uc, mpe)
+	for i := 0; i < 10; i++ {
+		uc.Put(ctx, fmt.Sprintf("item-%d", i), make([]byte, 10)) //nolint:errcheck
+		l.accessed(fmt.Sprintf("item-%d", i), 10, Metadata{}, true)
+	}
+
+	// items that could not be evicted are not counted
+	if count := l.Evict(ctx); count != 0 || mpe.shed != 0 {
+		t.Fatalf("expected nothing to be evicted, got %d items and %d bytes", count, mpe.shed)
+	}
+
+	// items nominated by concurrent evictions are only counted once
+	uc.fail = false
+	var nominated []string
+	for i := 0; i < 2; i++ {
+		l.lock.RLock()
+		nominated = append(nominated, mpe.Victims(layerView{l: l})...)
+		l.lock.RUnlock()
+	}
+	count := 0
+	for _, name := range nominated {
+		if l.evict(ctx, name) {
+			count++
+		}
+	}
+	if count != 5 || mpe.shed != 50 {
+		t.Fatalf("expected 5 items and 50 bytes to be evicted, got %d items and %d bytes", count, mpe.shed)
+	}
+	if count := l.Evict(ctx); count != 0 {
+		t.Fatalf("expected the evicted items to be deducted, got %d evicted items", count)
+	}
+}
+
+// hitRatio replays a workload of popular items, following a Zipf
+// distribution, interrupted by scans over items that are requested once.
+func hitRatio(b *testing.B, policy ReplacementPolicy, strategy EvictionStrategy) {
+	ctx := context.Background()
+	l := NewLayerWithPolicy(NewMemory(), policy, strategy)
+	r := rand.New(rand.NewSource(42))
+	zipf := rand.NewZipf(r, 1.1, 1, 999)
+	content := make([]byte, 1)
+
+	hits := 0
+	scan := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		name := fmt.Sprintf("popular-%d", zipf.Uint64())
+		if i%1000 < 200 {
+			// every 1000 requests 200 requests are part of a scan
+			scan++
+			name = fmt.Sprintf("scan-%d", scan)
+		}
+		if l.Exists(ctx, name) {
+			l.Get(ctx, name) //nolint:errcheck
+			hits++
+		} else {
+			l.Put(ctx, name, content) //nolint:errcheck
+		}
+		l.Wait(ctx) //nolint:errcheck
+	}
+	b.ReportMetric(float64(hits)/float64(b.N), "hits/op")
+}
+
+func BenchmarkEvictionHitRatio(b *testing.B) {
+	const capacity = 100
+	b.Run("LRU", func(b *testing.B) {
+		hitRatio(b, NewLRUPolicy(), NewMaxItemsEviction(capacity))
+	})
+	b.Run("ARC", func(b *testing.B) {
+		hitRatio(b, NewARCPolicy(capacity), NewMaxItemsEviction(capacity))
+	})
+	b.Run("LFU", func(b *testing.B) {
+		hitRatio(b, NewLRUPolicy(), NewLFUEviction(capacity, 0, time.Minute))
+	})
+	b.Run("TinyLFU", func(b *testing.B) {
+		hitRatio(b, NewLRUPolicy(), NewTinyLFUEviction(capacity, 0))
+	})
+	b.Run("GDSF", func(b *testing.B) {
+		hitRatio(b, NewLRUPolicy(), NewGDSFEviction(capacity, 0))
+	})
+}
+
+// putFull measures a put into a layer that is full with capacity items, so
+// every put evicts an item.
+func putFull(b *testing.B, capacity int, strategy EvictionStrategy) {
+	ctx := context.Background()
+	l := NewLayer(NewMemory(), strategy)
+	fill(b, l, capacity, 1)
+	content := make([]byte, 1)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.Put(ctx, fmt.Sprintf("new-%d", i), content) //nolint:errcheck
+		l.Wait(ctx)                                   //nolint:errcheck
+	}
+}
+
+func BenchmarkEvictionPutFull(b *testing.B) {
+	const capacity = 100000
+	b.Run("LRU", func(b *testing.B) {
+		putFull(b, capacity, NewMaxItemsEviction(capacity))
+	})
+	b.Run("LFU", func(b *testing.B) {
+		putFull(b, capacity, NewLFUEviction(capacity, 0, time.Minute))
+	})
+	b.Run("GDSF", func(b *testing.B) {
+		putFull(b, capacity, NewGDSFEviction(capacity, 0))
+	})
+}
@@ -0,0 +1,98 @@
+package imagecache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/TheHippo/imagecache/list"
+)
+
+// expiringCache remembers values by name for a limited time. The least
+// recently used entries are dropped when the maximum number of entries is
+// reached. A nil expiringCache remembers nothing.
+type expiringCache[V any] struct {
+	ttl     time.Duration
+	max     int
+	lock    sync.Mutex
+	order   *list.List[*expiringEntry[V]]
+	entries map[string]*list.Element[*expiringEntry[V]]
+}
+
+type expiringEntry[V any] struct {
+	name    string
+	value   V
+	expires time.Time
+}
+
+// newExpiringCache returns nil if ttl is not positive. A maxEntries of 0
+// means no limit.
+func newExpiringCache[V any](ttl time.Duration, maxEntries int) *expiringCache[V] {
+	if ttl <= 0 {
+		return nil
+	}
+	return &expiringCache[V]{
+		ttl:     ttl,
+		max:     maxEntries,
+		order:   list.NewList[*expiringEntry[V]](),
+		entries: make(map[string]*list.Element[*expiringEntry[V]]),
+	}
+}
+
+// get returns the value of name, unless it expired.
+func (ec *expiringCache[V]) get(name string) (value V, ok bool) {
+	if ec == nil {
+		return value, false
+	}
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	e, ok := ec.entries[name]
+	if !ok {
+		return value, false
+	}
+	if time.Now().After(e.Value.expires) {
+		ec.order.Remove(e)
+		delete(ec.entries, name)
+		return value, false
+	}
+	ec.order.MoveToFront(e)
+	return e.Value.value, true
+}
+
+// add remembers value for name.
+func (ec *expiringCache[V]) add(name string, value V) {
+	if ec == nil {
+		return
+	}
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	expires := time.Now().Add(ec.ttl)
+	if e, ok := ec.entries[name]; ok {
+		e.Value.value = value
+		e.Value.expires = expires
+		ec.order.MoveToFront(e)
+		return
+	}
+	ec.entries[name] = ec.order.PushFront(&expiringEntry[V]{
+		name:    name,
+		value:   value,
+		expires: expires,
+	})
+	for ec.max > 0 && ec.order.Len() > ec.max {
+		last := ec.order.Back()
+		ec.order.Remove(last)
+		delete(ec.entries, last.Value.name)
+	}
+}
+
+// remove forgets name.
+func (ec *expiringCache[V]) remove(name string) {
+	if ec == nil {
+		return
+	}
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	if e, ok := ec.entries[name]; ok {
+		ec.order.Remove(e)
+		delete(ec.entries, name)
+	}
+}
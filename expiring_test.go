@@ -0,0 +1,41 @@
+package imagecache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiringCacheTTL(t *testing.T) {
+	ec := newExpiringCache[int](50*time.Millisecond, 0)
+	ec.add("missing.jpg", 1)
+	if value, ok := ec.get("missing.jpg"); !ok || value != 1 {
+		t.Fatalf("expected name to be remembered, got %d", value)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := ec.get("missing.jpg"); ok {
+		t.Fatal("expected name to be forgotten after the ttl")
+	}
+}
+
+func TestExpiringCacheMaxEntries(t *testing.T) {
+	ec := newExpiringCache[int](time.Minute, 2)
+	ec.add("a", 1)
+	ec.add("b", 2)
+	// a is used more recently than b
+	ec.get("a")
+	ec.add("c", 3)
+	for name, known := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := ec.get(name); ok != known {
+			t.Errorf("expected %s to be remembered: %t", name, known)
+		}
+	}
+}
+
+func TestExpiringCacheNil(t *testing.T) {
+	ec := newExpiringCache[int](0, 10)
+	ec.add("a", 1)
+	if _, ok := ec.get("a"); ok {
+		t.Fatal("expected a nil cache to remember nothing")
+	}
+	ec.remove("a")
+}
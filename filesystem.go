@@ -9,6 +9,9 @@ type FileSystem struct {
 // compile-time check
 var _ Cacher = &FileSystem{}
 var _ Storer = &FileSystem{}
+var _ Versioner = &FileSystem{}
+var _ EntryCacher = &FileSystem{}
+var _ Enumerator = &FileSystem{}
 
 func NewFileSystem(path string) (*FileSystem, error) {
 	nfs, err := NewNestedFilesystem(path, 0)
@@ -22,6 +25,10 @@ func (fs *FileSystem) Get(ctx context.Context, name string) ([]byte, error) {
 	return fs.nfs.Get(ctx, name)
 }
 
+func (fs *FileSystem) GetEntry(ctx context.Context, name string) (Entry, error) {
+	return fs.nfs.GetEntry(ctx, name)
+}
+
 func (fs *FileSystem) Delete(ctx context.Context, name string) error {
 	return fs.nfs.Delete(ctx, name)
 }
@@ -30,10 +37,22 @@ func (fs *FileSystem) Exists(ctx context.Context, name string) bool {
 	return fs.nfs.Exists(ctx, name)
 }
 
+func (fs *FileSystem) Version(ctx context.Context, name string) (SourceVersion, error) {
+	return fs.nfs.Version(ctx, name)
+}
+
 func (fs *FileSystem) Put(ctx context.Context, name string, data []byte) error {
 	return fs.nfs.Put(ctx, name, data)
 }
 
-// func (f *FileSystem) Stats() (count int32, size int64) {
-// 	return f.nfs.Stats()
-// }
+func (fs *FileSystem) PutEntry(ctx context.Context, name string, entry Entry) error {
+	return fs.nfs.PutEntry(ctx, name, entry)
+}
+
+func (fs *FileSystem) Walk(ctx context.Context, fn func(StoredItem) error) error {
+	return fs.nfs.Walk(ctx, fn)
+}
+
+func (fs *FileSystem) RemoveUntracked(ctx context.Context) (int64, error) {
+	return fs.nfs.RemoveUntracked(ctx)
+}
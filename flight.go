@@ -0,0 +1,69 @@
+package imagecache
+
+import (
+	"context"
+	"sync"
+)
+
+// flightCall is a single in-flight piece of work, shared by all callers
+// asking for the same key.
+type flightCall struct {
+	done  chan struct{}
+	entry Entry
+	err   error
+}
+
+// flightGroup deduplicates concurrent work by key. Only the first caller
+// starts the work, every other caller waits for its result.
+type flightGroup struct {
+	lock    sync.Mutex
+	calls   map[string]*flightCall
+	running sync.WaitGroup
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{
+		calls: make(map[string]*flightCall),
+	}
+}
+
+// Do executes fn once for all concurrent callers with the same key. fn is
+// run with a context that is detached from the cancellation of the caller
+// that started it, so other waiters still receive the result if the first
+// caller goes away. Each caller stops waiting when its own context is done
+// and gets the context's error in that case. If fn succeeds and then is not
+// nil, then is called with the result after it was handed to the callers.
+// Callers joining while then runs get the result right away.
+func (g *flightGroup) Do(ctx context.Context, key string, fn func(context.Context) (Entry, error), then func(context.Context, Entry)) (Entry, error) {
+	g.lock.Lock()
+	call, ok := g.calls[key]
+	if !ok {
+		call = &flightCall{
+			done: make(chan struct{}),
+		}
+		g.calls[key] = call
+		g.running.Add(1)
+		go g.run(context.WithoutCancel(ctx), key, call, fn, then)
+	}
+	g.lock.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return Entry{}, ctx.Err()
+	case <-call.done:
+		return call.entry, call.err
+	}
+}
+
+func (g *flightGroup) run(ctx context.Context, key string, call *flightCall, fn func(context.Context) (Entry, error), then func(context.Context, Entry)) {
+	defer g.running.Done()
+	call.entry, call.err = fn(ctx)
+	close(call.done)
+	if call.err == nil && then != nil {
+		then(ctx, call.entry)
+	}
+
+	g.lock.Lock()
+	delete(g.calls, key)
+	g.lock.Unlock()
+}
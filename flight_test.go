@@ -0,0 +1,100 @@
+package imagecache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// joinContext signals joined once a caller of [flightGroup.Do] waits for
+// the result, which is when Do asks for the done channel.
+type joinContext struct {
+	context.Context
+	once   sync.Once
+	joined chan struct{}
+}
+
+func newJoinContext() *joinContext {
+	return &joinContext{
+		Context: context.Background(),
+		joined:  make(chan struct{}),
+	}
+}
+
+func (jc *joinContext) Done() <-chan struct{} {
+	jc.once.Do(func() { close(jc.joined) })
+	return jc.Context.Done()
+}
+
+func TestFlightGroupDeduplicates(t *testing.T) {
+	g := newFlightGroup()
+	release := make(chan struct{})
+	var calls atomic.Int32
+
+	var wg sync.WaitGroup
+	var joined []chan struct{}
+	for i := 0; i < 10; i++ {
+		ctx := newJoinContext()
+		joined = append(joined, ctx.joined)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entry, err := g.Do(ctx, "key", func(context.Context) (Entry, error) {
+				calls.Add(1)
+				<-release
+				return Entry{Content: []byte("done")}, nil
+			}, nil)
+			if err != nil || string(entry.Content) != "done" {
+				t.Errorf("unexpected result: %q, %v", entry.Content, err)
+			}
+		}()
+	}
+	for _, j := range joined {
+		<-j
+	}
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("expected work to be shared, got %d calls", n)
+	}
+}
+
+func TestFlightGroupLeaderCanceled(t *testing.T) {
+	g := newFlightGroup()
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error)
+	go func() {
+		_, err := g.Do(leaderCtx, "key", func(ctx context.Context) (Entry, error) {
+			close(started)
+			<-release
+			return Entry{Content: []byte("done")}, ctx.Err()
+		}, nil)
+		leaderErr <- err
+	}()
+	<-started
+
+	waiter := make(chan []byte)
+	waiterCtx := newJoinContext()
+	go func() {
+		entry, _ := g.Do(waiterCtx, "key", func(context.Context) (Entry, error) {
+			t.Error("second call should not start new work")
+			return Entry{}, nil
+		}, nil)
+		waiter <- entry.Content
+	}()
+	<-waiterCtx.joined
+
+	cancel()
+	if err := <-leaderErr; err != context.Canceled {
+		t.Fatalf("expected leader to be canceled, got %v", err)
+	}
+	close(release)
+	if content := <-waiter; string(content) != "done" {
+		t.Fatalf("waiter did not receive the result, got %q", content)
+	}
+}
@@ -0,0 +1,75 @@
+package imagecache
+
+import (
+	"sync"
+	"time"
+)
+
+// compile time checks
+var _ EvictionStrategy = &GDSFEviction{}
+var _ Observer = &GDSFEviction{}
+
+// GDSFEviction evicts items by GreedyDual-Size-Frequency when a certain
+// number of items or a certain size is reached. The priority of an item is
+//
+//	inflation + hits * cost / size
+//
+// where cost is the time it took to create the item, see [Metadata.Cost].
+// Small items that are expensive to create and used often are kept longest.
+// The inflation rises to the priority of the last evicted item, so items
+// that are no longer accessed age out over time. Items with unknown cost are
+// treated as cheap. It is an [Observer], so it must only be used by a single
+// layer.
+type GDSFEviction struct {
+	maxItems  int
+	maxSize   int64
+	lock      sync.Mutex
+	inflation float64
+	order     *scoreHeap
+}
+
+// NewGDSFEviction creates a new EvictionStrategy which evicts the items with
+// the lowest priority when more than maxItems items or more than maxSize
+// bytes are in the layer. 0 disables the respective limit.
+func NewGDSFEviction(maxItems int, maxSize int64) *GDSFEviction {
+	return &GDSFEviction{
+		maxItems: maxItems,
+		maxSize:  maxSize,
+		order:    newScoreHeap(),
+	}
+}
+
+// priority returns the priority of an item at its last access.
+func (g *GDSFEviction) priority(i ItemInfo) float64 {
+	cost := float64(max(i.Cost, time.Nanosecond))
+	size := float64(max(i.Size, 1))
+	return g.inflation + float64(max(i.Hits, 1))*cost/size
+}
+
+func (g *GDSFEviction) Observe(i ItemInfo) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.order.set(i, g.priority(i))
+}
+
+func (g *GDSFEviction) Forget(i ItemInfo, _ bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.order.remove(i.Name)
+}
+
+func (g *GDSFEviction) Victims(view LayerView) []string {
+	excessItems, excessSize := excess(view, g.maxItems, g.maxSize)
+	if excessItems <= 0 && excessSize <= 0 {
+		return nil
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	victims := make([]string, 0)
+	for _, s := range g.order.victims(excessItems, excessSize) {
+		victims = append(victims, s.name)
+		g.inflation = s.score
+	}
+	return victims
+}
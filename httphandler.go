@@ -0,0 +1,86 @@
+package imagecache
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// NameExtractor extracts the name of the requested image from r. Returns
+// false if the request does not contain a name.
+type NameExtractor func(r *http.Request) (string, bool)
+
+// PathValue extracts the name from the wildcard key of the pattern the
+// request was matched with by [http.ServeMux].
+//
+//	mux.Handle("GET /images/{name...}", imagecache.NewHTTPHandler(h, imagecache.PathValue("name")))
+func PathValue(key string) NameExtractor {
+	return func(r *http.Request) (string, bool) {
+		name := r.PathValue(key)
+		return name, name != ""
+	}
+}
+
+// PathValues extracts the name by joining the wildcards named keys of the pattern
+// the request was matched with by [http.ServeMux] with slashes. All
+// wildcards have to be present.
+func PathValues(keys ...string) NameExtractor {
+	return func(r *http.Request) (string, bool) {
+		values := make([]string, len(keys))
+		for i, key := range keys {
+			values[i] = r.PathValue(key)
+			if values[i] == "" {
+				return "", false
+			}
+		}
+		return strings.Join(values, "/"), len(values) > 0
+	}
+}
+
+// StripPrefix extracts the name from the path of the request URL, after
+// removing prefix. Requests with paths not starting with prefix have no name.
+func StripPrefix(prefix string) NameExtractor {
+	return func(r *http.Request) (string, bool) {
+		return strings.CutPrefix(r.URL.Path, prefix)
+	}
+}
+
+// QueryParam extracts the name from the query parameter key.
+func QueryParam(key string) NameExtractor {
+	return func(r *http.Request) (string, bool) {
+		name := r.URL.Query().Get(key)
+		return name, name != ""
+	}
+}
+
+// cleanName normalizes an extracted name, so it can't point outside of the
+// [Storer] with elements like "..".
+func cleanName(name string) (string, bool) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	return name, name != "" && !strings.ContainsRune(name, 0)
+}
+
+// NewHTTPHandler adapts a [Handler] to an [http.Handler]. The name of the
+// image is taken from the request by extract and cleaned before it is passed
+// to h. Only GET and HEAD requests are allowed, other methods are answered
+// with 405 Method Not Allowed. Requests without a name are answered with
+// 404 Not Found.
+func NewHTTPHandler(h Handler, extract NameExtractor) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			methodNotAllowed(w)
+			return
+		}
+		name, ok := extract(r)
+		if !ok {
+			notFound(w)
+			return
+		}
+		name, ok = cleanName(name)
+		if !ok {
+			notFound(w)
+			return
+		}
+		h(name, w, r)
+	})
+}
@@ -0,0 +1,41 @@
+package imagecache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPHandler(t *testing.T) {
+	var got string
+	h := NewHTTPHandler(func(name string, w http.ResponseWriter, r *http.Request) {
+		got = name
+	}, StripPrefix("/images/"))
+
+	tests := []struct {
+		method string
+		target string
+		code   int
+		name   string
+	}{
+		{http.MethodGet, "/images/photos/cat.jpg", http.StatusOK, "photos/cat.jpg"},
+		{http.MethodHead, "/images/cat.jpg", http.StatusOK, "cat.jpg"},
+		{http.MethodGet, "/images/photos/../../secret.jpg", http.StatusOK, "secret.jpg"},
+		{http.MethodGet, "/images/a//b/./cat.jpg", http.StatusOK, "a/b/cat.jpg"},
+		{http.MethodGet, "/images/", http.StatusNotFound, ""},
+		{http.MethodGet, "/other/cat.jpg", http.StatusNotFound, ""},
+		{http.MethodPost, "/images/cat.jpg", http.StatusMethodNotAllowed, ""},
+		{http.MethodDelete, "/images/cat.jpg", http.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		got = ""
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+		if w.Code != tt.code || got != tt.name {
+			t.Errorf("%s %s: expected %d %q, got %d %q", tt.method, tt.target, tt.code, tt.name, w.Code, got)
+		}
+		if tt.code == http.StatusMethodNotAllowed && w.Header().Get("Allow") != "GET, HEAD" {
+			t.Errorf("%s %s: expected Allow header, got %v", tt.method, tt.target, w.Header())
+		}
+	}
+}
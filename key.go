@@ -0,0 +1,177 @@
+package imagecache
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/h2non/bimg"
+)
+
+// KeyFunc calculates the part of the cache key that identifies the output
+// format and transformation of a variant. Different combinations have to
+// result in different keys, equivalent ones should result in the same key.
+type KeyFunc func(imageType bimg.ImageType, options bimg.Options) string
+
+// KeySchemaVersion is the version of the keys created by [CanonicalKey]. It
+// changes whenever the same options would result in different keys.
+const KeySchemaVersion = "v2"
+
+// CanonicalKey is the default [KeyFunc]. It normalizes the options before
+// encoding them, so that options with the same result share a key:
+//   - fields with zero values are ignored, independent of their order
+//   - fields of nested structs, like Watermark, are encoded one by one with
+//     their path, e.g. Watermark.Text, so the key does not depend on the
+//     layout of the structs
+//   - the default quality is the same as no quality
+//   - the deprecated SmartCrop is the same as [bimg.GravitySmart]
+//   - Embed is ignored when cropping, as cropping takes precedence
+//   - Gravity is ignored when not cropping
+//   - Type is ignored, as the output format is given by imageType
+//
+// The key contains [KeySchemaVersion] and the name of imageType.
+func CanonicalKey(imageType bimg.ImageType, options bimg.Options) string {
+	options = normalizeOptions(options)
+
+	fields := encodeFields("", reflect.ValueOf(options), nil)
+	slices.Sort(fields)
+
+	hash := sha256.Sum256([]byte(strings.Join(fields, "&")))
+	return fmt.Sprintf("%s-%s-%s", KeySchemaVersion, bimg.ImageTypeName(imageType), base64.RawURLEncoding.EncodeToString(hash[:18]))
+}
+
+// encodeFields appends all exported fields of the struct value with non-zero
+// values as path=value to fields. Fields of nested structs are encoded one by
+// one, values are formatted by their kind, not by their type.
+func encodeFields(prefix string, value reflect.Value, fields []string) []string {
+	for i := 0; i < value.NumField(); i++ {
+		field, fieldValue := value.Type().Field(i), value.Field(i)
+		if !field.IsExported() || fieldValue.IsZero() {
+			continue
+		}
+		path := prefix + field.Name
+		if fieldValue.Kind() == reflect.Struct {
+			fields = encodeFields(path+".", fieldValue, fields)
+			continue
+		}
+		fields = append(fields, path+"="+encodeValue(fieldValue))
+	}
+	return fields
+}
+
+// encodeValue formats a value that is not a struct.
+func encodeValue(value reflect.Value) string {
+	switch value.Kind() {
+	case reflect.Bool:
+		return strconv.FormatBool(value.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(value.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(value.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(value.Float(), 'g', -1, 64)
+	case reflect.String:
+		return strconv.Quote(value.String())
+	case reflect.Slice, reflect.Array:
+		if value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Uint8 {
+			// e.g. the image of a watermark
+			hash := sha256.Sum256(value.Bytes())
+			return hex.EncodeToString(hash[:])
+		}
+		elements := make([]string, value.Len())
+		for i := range elements {
+			elements[i] = encodeValue(value.Index(i))
+		}
+		return "[" + strings.Join(elements, ",") + "]"
+	}
+	return fmt.Sprintf("%v", value.Interface())
+}
+
+func normalizeOptions(options bimg.Options) bimg.Options {
+	options.Type = bimg.UNKNOWN
+	if options.Quality == bimg.Quality {
+		options.Quality = 0
+	}
+	if options.SmartCrop {
+		options.SmartCrop = false
+		options.Gravity = bimg.GravitySmart
+	}
+	cropping := options.Crop || options.Gravity == bimg.GravitySmart
+	if cropping {
+		options.Embed = false
+	} else {
+		options.Gravity = bimg.GravityCentre
+	}
+	return options
+}
+
+// ErrInvalidKey is returned when parsing a string that is not an encoded
+// [Key].
+var ErrInvalidKey = errors.New("invalid cache key")
+
+// keyPrefix marks encoded keys and the version of their encoding.
+const keyPrefix = "k1"
+
+// Key is the key a variant is cached with in the layers.
+type Key struct {
+	// Type is the output format.
+	Type bimg.ImageType
+	// Preset is the name of the preset, if the variant was created by one.
+	Preset string
+	// Transformation identifies the transformation, as calculated by the
+	// [KeyFunc] of the cache.
+	Transformation string
+	// Version is the version of the original, if known. See [Versioner].
+	Version string
+	// Source is the name of the original.
+	Source string
+}
+
+// String encodes the key. All parts are escaped, so names containing
+// separators can't be confused with other keys. The result can be decoded
+// by [ParseKey].
+func (k Key) String() string {
+	return strings.Join([]string{
+		keyPrefix,
+		bimg.ImageTypeName(k.Type),
+		url.PathEscape(k.Preset),
+		url.PathEscape(k.Transformation),
+		url.PathEscape(k.Version),
+		url.PathEscape(k.Source),
+	}, "/")
+}
+
+// ParseKey decodes a key encoded by [Key.String]. Returns an error wrapping
+// [ErrInvalidKey] if s is not a valid key.
+func ParseKey(s string) (Key, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 6 || parts[0] != keyPrefix {
+		return Key{}, fmt.Errorf("%w: '%s'", ErrInvalidKey, s)
+	}
+	k := Key{
+		Type: bimg.UNKNOWN,
+	}
+	for t, name := range bimg.ImageTypes {
+		if name == parts[1] {
+			k.Type = t
+		}
+	}
+	if k.Type == bimg.UNKNOWN {
+		return Key{}, fmt.Errorf("%w: unknown type '%s'", ErrInvalidKey, parts[1])
+	}
+	for i, field := range []*string{&k.Preset, &k.Transformation, &k.Version, &k.Source} {
+		unescaped, err := url.PathUnescape(parts[i+2])
+		if err != nil {
+			return Key{}, fmt.Errorf("%w: %w", ErrInvalidKey, err)
+		}
+		*field = unescaped
+	}
+	return k, nil
+}
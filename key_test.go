@@ -0,0 +1,93 @@
+package imagecache
+
+import (
+	"testing"
+
+	"github.com/h2non/bimg"
+)
+
+func TestCanonicalKey(t *testing.T) {
+	same := []struct {
+		a, b bimg.Options
+	}{
+		{bimg.Options{}, bimg.Options{Quality: bimg.Quality}},
+		{bimg.Options{Width: 100, Crop: true}, bimg.Options{Width: 100, Crop: true, Embed: true}},
+		{bimg.Options{Width: 100, SmartCrop: true}, bimg.Options{Width: 100, Gravity: bimg.GravitySmart}},
+		{bimg.Options{Width: 100}, bimg.Options{Width: 100, Gravity: bimg.GravityNorth}},
+		{bimg.Options{Width: 100}, bimg.Options{Width: 100, Type: bimg.PNG}},
+	}
+	for _, tt := range same {
+		if a, b := CanonicalKey(bimg.JPEG, tt.a), CanonicalKey(bimg.JPEG, tt.b); a != b {
+			t.Errorf("expected %+v and %+v to share a key, got %s and %s", tt.a, tt.b, a, b)
+		}
+	}
+
+	different := []struct {
+		a, b bimg.Options
+	}{
+		{bimg.Options{Width: 100}, bimg.Options{Height: 100}},
+		{bimg.Options{Width: 100, Crop: true}, bimg.Options{Width: 100, Crop: true, Gravity: bimg.GravityNorth}},
+		{bimg.Options{Quality: 80}, bimg.Options{}},
+		{bimg.Options{Watermark: bimg.Watermark{Text: "a"}}, bimg.Options{Watermark: bimg.Watermark{Text: "b"}}},
+		{bimg.Options{Watermark: bimg.Watermark{Text: "a"}}, bimg.Options{Watermark: bimg.Watermark{Font: "a"}}},
+		{bimg.Options{WatermarkImage: bimg.WatermarkImage{Buf: []byte{1}}}, bimg.Options{WatermarkImage: bimg.WatermarkImage{Buf: []byte{2}}}},
+		{bimg.Options{Background: bimg.Color{R: 255}}, bimg.Options{Background: bimg.Color{G: 255}}},
+		{bimg.Options{Sharpen: bimg.Sharpen{Radius: 1}}, bimg.Options{GaussianBlur: bimg.GaussianBlur{Sigma: 1}}},
+	}
+	for _, tt := range different {
+		if a, b := CanonicalKey(bimg.JPEG, tt.a), CanonicalKey(bimg.JPEG, tt.b); a == b {
+			t.Errorf("expected %+v and %+v to have different keys, got %s", tt.a, tt.b, a)
+		}
+	}
+
+	if CanonicalKey(bimg.JPEG, bimg.Options{}) == CanonicalKey(bimg.WEBP, bimg.Options{}) {
+		t.Error("expected the image type to be part of the key")
+	}
+}
+
+func TestCanonicalKeyStable(t *testing.T) {
+	// keys must only change with KeySchemaVersion, not with the layout of
+	// the options
+	options := bimg.Options{
+		Width:        300,
+		Crop:         true,
+		Gravity:      bimg.GravitySmart,
+		Background:   bimg.Color{R: 255, G: 255, B: 255},
+		Watermark:    bimg.Watermark{Text: "cats", Opacity: 0.5},
+		GaussianBlur: bimg.GaussianBlur{Sigma: 1.5},
+	}
+	if key, want := CanonicalKey(bimg.WEBP, options), "v2-webp-0Nl71rvNsmXMPL7tGqpYHTuc"; key != want {
+		t.Errorf("expected key %s, got %s", want, key)
+	}
+}
+
+func TestKeyRoundTrip(t *testing.T) {
+	keys := []Key{
+		{Type: bimg.JPEG, Transformation: "v1-jpeg-abc", Source: "cat.jpg"},
+		{Type: bimg.WEBP, Preset: "hero@2x", Transformation: "v1-webp-abc", Version: "1a.2b", Source: "photos/2024/cat-1.jpg"},
+		{Type: bimg.AVIF, Preset: "a/b", Transformation: "x-y", Source: "../%2F/k1/jpeg"},
+	}
+	for _, k := range keys {
+		parsed, err := ParseKey(k.String())
+		if err != nil {
+			t.Errorf("ParseKey(%q) failed: %v", k.String(), err)
+			continue
+		}
+		if parsed != k {
+			t.Errorf("ParseKey(%q) = %+v, want %+v", k.String(), parsed, k)
+		}
+	}
+
+	// names with separators must not collide
+	a := Key{Type: bimg.JPEG, Transformation: "t", Source: "a-b"}
+	b := Key{Type: bimg.JPEG, Transformation: "t-a", Source: "b"}
+	if a.String() == b.String() {
+		t.Errorf("keys collide: %s", a)
+	}
+
+	for _, s := range []string{"", "k1/jpeg/a/b", "k2/jpeg////x", "k1/bmp////x", "k1/jpeg////%zz"} {
+		if _, err := ParseKey(s); err == nil {
+			t.Errorf("expected %q to be invalid", s)
+		}
+	}
+}
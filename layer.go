@@ -2,51 +2,91 @@ package imagecache
 
 import (
 	"context"
+	"errors"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
-
-	"github.com/TheHippo/imagecache/list"
 )
 
+// ErrNotAdmitted is returned when putting a new item into a [Layer] that is
+// refused by an [Admitter].
+var ErrNotAdmitted = errors.New("item not admitted to the layer")
+
 // Layer represents a caching layer
 type Layer struct {
-	cache     Cacher
+	cache     EntryCacher
 	evictions []EvictionStrategy
 	size      atomic.Int64
 	count     atomic.Int32
-	access    *list.List[*item]
-	inventory map[string]*list.Element[*item]
-	lock      sync.RWMutex
+	// untracked is the size of content without name, not part of size
+	untracked atomic.Int64
+	policy    ReplacementPolicy
+	inventory map[string]*item
+	byCreated *itemHeap
+	byExpires *itemHeap
+	// byLastAccess holds all items
+	byLastAccess *itemHeap
+	lock         sync.RWMutex
+	pending      sync.WaitGroup
+	// onEvict is called with the name of every evicted item
+	onEvict func(name string)
+	// onRestore is called with the name of every restored item
+	onRestore func(name string)
 }
 
 // item within the caching layer
 type item struct {
 	name       string
+	created    time.Time
 	lastAccess time.Time
+	expires    time.Time
+	cost       time.Duration
 	size       int64
+	hits       uint64
+	// index in byCreated or byExpires of the layer
+	index int
+	// index in byLastAccess of the layer
+	accessIndex int
 }
 
 // LayerStats contains information about the cache items
 // in the layer
 //   - Count of items
 //   - Size of items in bytes
+//   - Untracked content in bytes, found by [Layer.Rebuild] without a name,
+//     which is not part of Size
 type LayerStats struct {
-	Count int32
-	Size  int64
+	Count     int32
+	Size      int64
+	Untracked int64
 }
 
 // compile time check
 var _ Cacher = &Layer{}
+var _ EntryCacher = &Layer{}
 
 // NewLayer creates a new caching layer with various eviction strategies.
 // If no evicition strategy is passed the items will never be deleted.
+// Metadata is only stored if cache implements [EntryCacher]. Items are
+// evicted in the order of their last access, see [LRUPolicy].
 func NewLayer(cache Cacher, evictions ...EvictionStrategy) *Layer {
+	return NewLayerWithPolicy(cache, NewLRUPolicy(), evictions...)
+}
+
+// NewLayerWithPolicy creates a new caching layer like [NewLayer], which
+// evicts items in the order of policy.
+func NewLayerWithPolicy(cache Cacher, policy ReplacementPolicy, evictions ...EvictionStrategy) *Layer {
 	return &Layer{
-		cache:     cache,
+		cache:     Entries(cache),
 		evictions: evictions,
-		access:    list.NewList[*item](),
-		inventory: make(map[string]*list.Element[*item], 0),
+		policy:    policy,
+		inventory: make(map[string]*item, 0),
+		byCreated: newItemHeap(byCreated, expiryIndex),
+		byExpires: newItemHeap(byExpires, expiryIndex),
+		byLastAccess: newItemHeap(byLastAccess, func(i *item) *int {
+			return &i.accessIndex
+		}),
 	}
 }
 
@@ -55,6 +95,7 @@ func NewLayer(cache Cacher, evictions ...EvictionStrategy) *Layer {
 // and stop it provide a Context that can be canceled.
 func (l *Layer) BackgroundEviction(ctx context.Context, dur time.Duration) {
 	ticker := time.NewTicker(dur)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ctx.Done():
@@ -65,34 +106,111 @@ func (l *Layer) BackgroundEviction(ctx context.Context, dur time.Duration) {
 	}
 }
 
-func (l *Layer) deleteLast(ctx context.Context) {
+// evict removes the item name from the underlying cache and the inventory.
+// Returns false if the item is unknown or could not be deleted.
+func (l *Layer) evict(ctx context.Context, name string) bool {
+	l.lock.Lock()
+	i, ok := l.inventory[name]
+	if !ok {
+		l.lock.Unlock()
+		return false
+	}
+	if err := l.cache.Delete(ctx, name); err != nil {
+		l.lock.Unlock()
+		return false
+	}
+	l.forget(i, true)
+	onEvict := l.onEvict
+	l.lock.Unlock()
+
+	if onEvict != nil {
+		onEvict(name)
+	}
+	return true
+}
+
+// setOnEvict sets the function that is called with the name of every item
+// evicted from the layer.
+func (l *Layer) setOnEvict(fn func(name string)) {
 	l.lock.Lock()
 	defer l.lock.Unlock()
+	l.onEvict = fn
+}
 
-	last := l.access.Back()
-	if last == nil {
-		// nothing in cache
-		return
+// setOnRestore sets the function that is called with the name of every item
+// restored by [Layer.Rebuild] or [Layer.LoadSnapshot]. It is called right
+// away for the items the layer already knows.
+func (l *Layer) setOnRestore(fn func(name string)) {
+	l.lock.Lock()
+	l.onRestore = fn
+	names := make([]string, 0, len(l.inventory))
+	for name := range l.inventory {
+		names = append(names, name)
+	}
+	l.lock.Unlock()
+	for _, name := range names {
+		fn(name)
 	}
-	if err := l.cache.Delete(ctx, last.Value.name); err != nil {
+}
+
+// restored calls the hook set by setOnRestore for names. The layer must not
+// be locked.
+func (l *Layer) restored(names []string) {
+	l.lock.RLock()
+	onRestore := l.onRestore
+	l.lock.RUnlock()
+	if onRestore == nil {
 		return
 	}
-	l.count.Add(-1)
-	l.size.Add(-last.Value.size)
-	delete(l.inventory, last.Value.name)
-	l.access.Remove(last)
+	for _, name := range names {
+		onRestore(name)
+	}
+}
+
+// tracks reports if the item name is in the inventory of the layer.
+func (l *Layer) tracks(name string) bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	_, ok := l.inventory[name]
+	return ok
+}
+
+// record informs all strategies that are an [Admitter] about an access.
+func (l *Layer) record(name string) {
+	for _, e := range l.evictions {
+		if a, ok := e.(Admitter); ok {
+			a.Record(name)
+		}
+	}
+}
+
+// admit asks all strategies that are an [Admitter] if the item name can be
+// put into the layer. Items that are already in the layer are always
+// admitted.
+func (l *Layer) admit(name string, size int64) bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if _, ok := l.inventory[name]; ok {
+		return true
+	}
+	for _, e := range l.evictions {
+		if a, ok := e.(Admitter); ok && !a.Admit(layerView{l: l}, name, size) {
+			return false
+		}
+	}
+	return true
 }
 
 // Evict instructs all Evictionstrategies to remove items that need to be evicted.
 // Returns the number of items that were evicted.
 func (l *Layer) Evict(ctx context.Context) (count int) {
 	for _, e := range l.evictions {
-		for {
-			if e.check(l) {
+		l.lock.RLock()
+		victims := e.Victims(layerView{l: l})
+		l.lock.RUnlock()
+		for _, name := range victims {
+			if l.evict(ctx, name) {
 				count++
-				l.deleteLast(ctx)
-			} else {
-				break
 			}
 		}
 	}
@@ -106,13 +224,12 @@ func (l *Layer) Delete(ctx context.Context, name string) error {
 		return err
 	}
 
+	l.pending.Add(1)
 	go func(name string) {
+		defer l.pending.Done()
 		l.lock.Lock()
-		if e, ok := l.inventory[name]; ok {
-			l.count.Add(-1)
-			l.size.Add(-e.Value.size)
-			l.access.Remove(e)
-			delete(l.inventory, name)
+		if i, ok := l.inventory[name]; ok {
+			l.forget(i, false)
 		}
 		l.lock.Unlock()
 	}(name)
@@ -126,23 +243,112 @@ func (l *Layer) Exists(ctx context.Context, name string) bool {
 	return l.cache.Exists(ctx, name)
 }
 
-func (l *Layer) accessed(name string, size int64) {
+// forget removes an item from the inventory, because it was evicted or
+// deleted. The layer has to be locked.
+func (l *Layer) forget(i *item, evicted bool) {
+	l.count.Add(-1)
+	l.size.Add(-i.size)
+	delete(l.inventory, i.name)
+	if evicted {
+		l.policy.Evict(i.name)
+	} else {
+		l.policy.Remove(i.name)
+	}
+	l.unschedule(i)
+	l.byLastAccess.remove(i)
+	for _, e := range l.evictions {
+		if o, ok := e.(Observer); ok {
+			o.Forget(i.info(), evicted)
+		}
+	}
+}
+
+// observe informs all strategies that are an [Observer] about the changed
+// item i. The layer has to be locked.
+func (l *Layer) observe(i *item) {
+	for _, e := range l.evictions {
+		if o, ok := e.(Observer); ok {
+			o.Observe(i.info())
+		}
+	}
+}
+
+// schedule adds i to the heap used for its expiry. The layer has to be
+// locked.
+func (l *Layer) schedule(i *item) {
+	if i.expires.IsZero() {
+		l.byCreated.add(i)
+	} else {
+		l.byExpires.add(i)
+	}
+}
+
+// unschedule removes i from the heap used for its expiry. The layer has to
+// be locked.
+func (l *Layer) unschedule(i *item) {
+	l.byCreated.remove(i)
+	l.byExpires.remove(i)
+}
+
+// restore adds an item to the inventory as the next item to evict, unless
+// it is already known. Returns false if it was known. The layer has to be
+// locked.
+func (l *Layer) restore(i *item) bool {
+	if _, ok := l.inventory[i.name]; ok {
+		return false
+	}
+	l.inventory[i.name] = i
+	l.policy.Restore(i.name)
+	l.schedule(i)
+	l.byLastAccess.add(i)
+	l.observe(i)
+	l.count.Add(1)
+	l.size.Add(i.size)
+	return true
+}
+
+// accessed records an access to the item name with metadata. If put is
+// true, the item was just written.
+func (l *Layer) accessed(name string, size int64, metadata Metadata, put bool) {
+	now := time.Now()
+	created := metadata.Created
+	if created.IsZero() {
+		created = now
+	}
 	l.lock.Lock()
-	e, ok := l.inventory[name]
+	i, ok := l.inventory[name]
 	if !ok {
-		i := &item{
+		i = &item{
 			name:       name,
-			lastAccess: time.Now(),
+			created:    created,
+			lastAccess: now,
+			expires:    metadata.Expires,
+			cost:       metadata.Cost,
 			size:       size,
+			hits:       1,
 		}
-		l.inventory[name] = l.access.PushFront(i)
+		l.inventory[name] = i
+		l.schedule(i)
+		l.byLastAccess.add(i)
 		l.count.Add(1)
 		l.size.Add(size)
 	} else {
-		e.Value.lastAccess = time.Now()
-		e.Value.size = size
-		l.access.MoveToFront(e)
+		if put {
+			l.unschedule(i)
+			i.created = created
+			i.expires = metadata.Expires
+			i.cost = metadata.Cost
+			l.schedule(i)
+		}
+		// update size, the item might have changed
+		l.size.Add(size - i.size)
+		i.lastAccess = now
+		i.size = size
+		i.hits++
+		l.byLastAccess.fix(i)
 	}
+	l.policy.Touch(name)
+	l.observe(i)
 	l.lock.Unlock()
 }
 
@@ -151,46 +357,135 @@ func (l *Layer) accessed(name string, size int64) {
 // the error depends on the underlying cache. This also
 // counts as an access to the item.
 func (l *Layer) Get(ctx context.Context, name string) ([]byte, error) {
-	content, err := l.cache.Get(ctx, name)
+	entry, err := l.GetEntry(ctx, name)
 	if err != nil {
 		return nil, err
 	}
+	return entry.Content, nil
+}
+
+// GetEntry gets an item with its metadata from the layer. Behaves
+// like [Layer.Get].
+func (l *Layer) GetEntry(ctx context.Context, name string) (Entry, error) {
+	entry, err := l.cache.GetEntry(ctx, name)
+	if err != nil {
+		return Entry{}, err
+	}
+	l.record(name)
 	// this is necessary because there might be items in the
 	// cache that the cache isn't aware of. (filesystem after restart)
-	go l.accessed(name, int64(len(content)))
-	return content, nil
+	l.pending.Add(1)
+	go func(size int64) {
+		defer l.pending.Done()
+		l.accessed(name, size, entry.Metadata, false)
+	}(int64(len(entry.Content)))
+	return entry, nil
 }
 
 // Put an item into the layer. Required a key and the content itself.
 // Returns an error if something went wrong. The exact error depends
 // on the underlying cache. If the item already exists the item is
-// overwritten. This also counts as an access to the item.
+// overwritten. This also counts as an access to the item. New items
+// that are not admitted by an [Admitter] are not stored and
+// [ErrNotAdmitted] is returned.
 func (l *Layer) Put(ctx context.Context, name string, content []byte) error {
-	if err := l.cache.Put(ctx, name, content); err != nil {
+	return l.PutEntry(ctx, name, Entry{
+		Content: content,
+	})
+}
+
+// PutEntry puts an item with its metadata into the layer. Behaves
+// like [Layer.Put].
+func (l *Layer) PutEntry(ctx context.Context, name string, entry Entry) error {
+	l.record(name)
+	if !l.admit(name, int64(len(entry.Content))) {
+		return ErrNotAdmitted
+	}
+	if err := l.cache.PutEntry(ctx, name, entry); err != nil {
 		return err
 	}
 
+	l.pending.Add(1)
 	go func(name string, size int64) {
-		// update size, if already in cache
-		l.lock.RLock()
-		if e, ok := l.inventory[name]; ok {
-			old := e.Value.size
-			diff := size - old
-			l.size.Add(int64(diff))
+		defer l.pending.Done()
+		l.accessed(name, size, entry.Metadata, true)
+		l.Evict(context.WithoutCancel(ctx))
+	}(name, int64(len(entry.Content)))
+
+	return nil
+}
+
+// Wait blocks until the bookkeeping of all preceding operations on the layer
+// is done, or ctx is done. In the latter case the error of ctx is returned.
+func (l *Layer) Wait(ctx context.Context) error {
+	return wait(ctx, &l.pending)
+}
+
+// enumerator returns the underlying cache as an [Enumerator], if supported.
+func (l *Layer) enumerator() (Enumerator, bool) {
+	if pe, ok := l.cache.(*plainEntries); ok {
+		e, ok := pe.Cacher.(Enumerator)
+		return e, ok
+	}
+	e, ok := l.cache.(Enumerator)
+	return e, ok
+}
 
+// Rebuild restores the information about items from the underlying cache,
+// e.g. after a restart. The time of the last access is approximated by the
+// modification time of the item. Items accessed before are kept as they are.
+// Content without a name can't be evicted, its size is reported as untracked
+// and not seen by eviction strategies, see [NestedFileSystem.RemoveUntracked].
+// Returns [ErrNotEnumerable] if the underlying cache can't list its items.
+func (l *Layer) Rebuild(ctx context.Context) error {
+	enumerator, ok := l.enumerator()
+	if !ok {
+		return ErrNotEnumerable
+	}
+	items := make([]StoredItem, 0)
+	var untracked int64
+	err := enumerator.Walk(ctx, func(si StoredItem) error {
+		if si.Name == "" {
+			untracked += si.Size
+			return nil
 		}
-		l.lock.RUnlock()
-		l.accessed(name, size)
-		l.Evict(ctx)
-	}(name, int64(len(content)))
+		items = append(items, si)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// most recently modified first
+	slices.SortFunc(items, func(a, b StoredItem) int {
+		return b.ModTime.Compare(a.ModTime)
+	})
 
+	names := make([]string, 0, len(items))
+	l.lock.Lock()
+	l.untracked.Store(untracked)
+	for _, si := range items {
+		restored := l.restore(&item{
+			name:       si.Name,
+			created:    si.ModTime,
+			lastAccess: si.ModTime,
+			expires:    si.Expires,
+			cost:       si.Cost,
+			size:       si.Size,
+		})
+		if restored {
+			names = append(names, si.Name)
+		}
+	}
+	l.lock.Unlock()
+	l.restored(names)
 	return nil
 }
 
 // Stats returns the current state of the layer.
 func (l *Layer) Stats() *LayerStats {
 	return &LayerStats{
-		Count: l.count.Load(),
-		Size:  l.size.Load(),
+		Count:     l.count.Load(),
+		Size:      l.size.Load(),
+		Untracked: l.untracked.Load(),
 	}
 }
@@ -0,0 +1,89 @@
+package imagecache
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// compile time checks
+var _ EvictionStrategy = &LFUEviction{}
+var _ Observer = &LFUEviction{}
+
+// LFUEviction evicts the least frequently used items when a certain number
+// of items or a certain size is reached. The frequency of an item is the
+// number of its accesses, which ages with the time since the last access,
+// so items that were popular once don't stay forever. It is an [Observer],
+// so it must only be used by a single layer.
+type LFUEviction struct {
+	maxItems int
+	maxSize  int64
+	halfLife time.Duration
+	lock     sync.RWMutex
+	order    *scoreHeap
+}
+
+// NewLFUEviction creates a new EvictionStrategy which evicts the least
+// frequently used items when more than maxItems items or more than maxSize
+// bytes are in the layer. 0 disables the respective limit. The frequency of
+// an item is halved every halfLife it is not accessed, 0 disables aging.
+func NewLFUEviction(maxItems int, maxSize int64, halfLife time.Duration) *LFUEviction {
+	return &LFUEviction{
+		maxItems: maxItems,
+		maxSize:  maxSize,
+		halfLife: halfLife,
+		order:    newScoreHeap(),
+	}
+}
+
+// score orders items like their aged number of accesses. The aged frequency
+//
+//	hits * 2^(-(now - lastAccess) / halfLife)
+//
+// changes with the time, but its order does not: it is the order of
+// log2(hits) + lastAccess / halfLife, which only changes on access.
+func (lfu *LFUEviction) score(i ItemInfo) float64 {
+	if lfu.halfLife <= 0 {
+		return float64(i.Hits)
+	}
+	return math.Log2(float64(i.Hits)) + float64(i.LastAccess.UnixNano())/float64(lfu.halfLife)
+}
+
+func (lfu *LFUEviction) Observe(i ItemInfo) {
+	lfu.lock.Lock()
+	defer lfu.lock.Unlock()
+	lfu.order.set(i, lfu.score(i))
+}
+
+func (lfu *LFUEviction) Forget(i ItemInfo, _ bool) {
+	lfu.lock.Lock()
+	defer lfu.lock.Unlock()
+	lfu.order.remove(i.Name)
+}
+
+func (lfu *LFUEviction) Victims(view LayerView) []string {
+	excessItems, excessSize := excess(view, lfu.maxItems, lfu.maxSize)
+	if excessItems <= 0 && excessSize <= 0 {
+		return nil
+	}
+
+	lfu.lock.RLock()
+	defer lfu.lock.RUnlock()
+	victims := make([]string, 0)
+	for _, s := range lfu.order.victims(excessItems, excessSize) {
+		victims = append(victims, s.name)
+	}
+	return victims
+}
+
+// excess returns by how many items and bytes the layer exceeds the limits.
+// Limits of 0 are ignored.
+func excess(view LayerView, maxItems int, maxSize int64) (items int, size int64) {
+	if maxItems > 0 {
+		items = int(view.Count()) - maxItems
+	}
+	if maxSize > 0 {
+		size = view.Size() - maxSize
+	}
+	return
+}
@@ -0,0 +1,164 @@
+package imagecache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+)
+
+// ErrClosed is returned when using a [Cache] after it was closed.
+var ErrClosed = errors.New("cache is closed")
+
+// acquire registers a request that is served. Returns false if the cache is
+// closed and no more requests are accepted.
+func (c *Cache) acquire() bool {
+	c.lifecycle.RLock()
+	defer c.lifecycle.RUnlock()
+	if c.closed {
+		return false
+	}
+	c.active.Add(1)
+	return true
+}
+
+// snapshotPath returns the path of the snapshot of layer i.
+func (c *Cache) snapshotPath(i int) string {
+	return filepath.Join(c.snapshotDir, fmt.Sprintf("layer-%d.json", i))
+}
+
+// Start starts the background work of the cache, like the eviction of items
+// configured by [WithBackgroundEviction]. If snapshots are configured by
+// [WithSnapshots], the state of the layers is restored from them first, and
+// items missing in the snapshots are restored by [Layer.Rebuild]. Requests
+// are served while the layers are restored. Snapshots that can't be loaded
+// are never replaced. The background work runs until the cache is closed,
+// ctx is only used while starting. Starting a cache twice has no effect.
+func (c *Cache) Start(ctx context.Context) error {
+	c.lifecycle.Lock()
+	if c.closed {
+		c.lifecycle.Unlock()
+		return ErrClosed
+	}
+	if c.started {
+		c.lifecycle.Unlock()
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		c.lifecycle.Unlock()
+		return err
+	}
+	c.started = true
+	c.lifecycle.Unlock()
+
+	// requests are served while the layers are restored
+	var errs []error
+	loaded := make([]bool, len(c.layers))
+	if c.snapshotDir != "" {
+		for i, l := range c.layers {
+			err := l.LoadSnapshot(ctx, c.snapshotPath(i))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				errs = append(errs, &LayerError{
+					Layer: i,
+					Err:   err,
+				})
+			} else {
+				loaded[i] = true
+			}
+			if err := l.Rebuild(ctx); err != nil && !errors.Is(err, ErrNotEnumerable) {
+				errs = append(errs, &LayerError{
+					Layer: i,
+					Err:   err,
+				})
+			}
+		}
+	}
+
+	c.lifecycle.Lock()
+	defer c.lifecycle.Unlock()
+	if c.closed {
+		// closed while restoring, nothing to start
+		return errors.Join(append(errs, ErrClosed)...)
+	}
+	background, cancel := context.WithCancel(context.Background())
+	c.stopBackground = cancel
+	c.loaded = loaded
+	if c.snapshotDir != "" && c.snapshotInterval > 0 {
+		for i, l := range c.layers {
+			if !loaded[i] {
+				continue
+			}
+			c.background.Add(1)
+			go func(i int, l *Layer) {
+				defer c.background.Done()
+				l.BackgroundSnapshot(background, c.snapshotPath(i), c.snapshotInterval)
+			}(i, l)
+		}
+	}
+	if c.evictionInterval > 0 {
+		for _, l := range c.layers {
+			c.background.Add(1)
+			go func(l *Layer) {
+				defer c.background.Done()
+				l.BackgroundEviction(background, c.evictionInterval)
+			}(l)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close shuts the cache down. New requests are answered with
+// 503 Service Unavailable. Close waits for running requests and
+// transformations, stops the background work started by [Cache.Start],
+// waits for pending writes to the layers and for the bookkeeping of the
+// layers. Finally snapshots of the layers are saved, if configured by
+// [WithSnapshots] and loaded by [Cache.Start] before. If ctx is done before,
+// Close gives up waiting. All errors are returned joined.
+func (c *Cache) Close(ctx context.Context) error {
+	c.lifecycle.Lock()
+	if c.closed {
+		c.lifecycle.Unlock()
+		return ErrClosed
+	}
+	c.closed = true
+	stop := c.stopBackground
+	loaded := c.loaded
+	c.lifecycle.Unlock()
+
+	var errs []error
+	if err := wait(ctx, &c.active); err != nil {
+		errs = append(errs, fmt.Errorf("waiting for requests: %w", err))
+	}
+	if err := wait(ctx, &c.flights.running); err != nil {
+		errs = append(errs, fmt.Errorf("waiting for transformations: %w", err))
+	}
+	if stop != nil {
+		stop()
+		if err := wait(ctx, &c.background); err != nil {
+			errs = append(errs, fmt.Errorf("waiting for background work: %w", err))
+		}
+	}
+	if err := c.writeBack.close(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("waiting for writes: %w", err))
+	}
+	for i, l := range c.layers {
+		if err := l.Wait(ctx); err != nil {
+			errs = append(errs, &LayerError{
+				Layer: i,
+				Err:   err,
+			})
+		}
+		if i >= len(loaded) || !loaded[i] {
+			// don't replace a snapshot that was never loaded
+			continue
+		}
+		if err := l.SaveSnapshot(c.snapshotPath(i)); err != nil {
+			errs = append(errs, &LayerError{
+				Layer: i,
+				Err:   err,
+			})
+		}
+	}
+	return errors.Join(errs...)
+}
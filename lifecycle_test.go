@@ -0,0 +1,196 @@
+package imagecache
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCloseDrains(t *testing.T) {
+	ctx := context.Background()
+	c, store := newTestCache(t)
+	h, err := c.Handle(testVariant(t, c).imageType, testOptions)
+	if err != nil {
+		t.Skip(err)
+	}
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	store.Put(ctx, "cat.png", testImage(t)) //nolint:errcheck
+	if w := get(h, "cat.png", nil); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the write and the bookkeeping of the layer are done
+	if stats := c.layers[0].Stats(); stats.Count != 1 {
+		t.Fatalf("expected the variant in the layer, got %+v", stats)
+	}
+	if stats := c.WriteBackStats(); stats.Written != 1 || stats.Pending != 0 {
+		t.Fatalf("expected 1 written write, got %+v", stats)
+	}
+
+	if w := get(h, "cat.png", nil); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 after close, got %d", w.Code)
+	}
+	if err := c.Close(ctx); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if err := c.Start(ctx); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed when starting, got %v", err)
+	}
+}
+
+func TestCloseStopsBackgroundEviction(t *testing.T) {
+	ctx := context.Background()
+	l := NewLayer(NewMemory(), NewLastAccessEviction(20*time.Millisecond))
+	c := NewWithOptions(NewMemory(), []*Layer{l}, WithBackgroundEviction(5*time.Millisecond))
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	l.Put(ctx, "evicted", []byte{1}) //nolint:errcheck
+	deadline := time.Now().Add(time.Second)
+	for l.Exists(ctx, "evicted") {
+		if time.Now().After(deadline) {
+			t.Fatal("expected background eviction to evict the item")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	l.Put(ctx, "kept", []byte{1}) //nolint:errcheck
+	time.Sleep(100 * time.Millisecond)
+	if !l.Exists(ctx, "kept") {
+		t.Fatal("expected background eviction to be stopped")
+	}
+}
+
+func TestCloseKeepsSnapshots(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	newCache := func() (*Cache, *Layer) {
+		l := NewLayer(NewMemory())
+		return NewWithOptions(NewMemory(), []*Layer{l}, WithSnapshots(dir, 0)), l
+	}
+	snapshot := func() string {
+		content, err := os.ReadFile(filepath.Join(dir, "layer-0.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+
+	c, l := newCache()
+	l.Put(ctx, "a", []byte{1}) //nolint:errcheck
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	saved := snapshot()
+	if !strings.Contains(saved, `"a"`) {
+		t.Fatalf("expected a in the snapshot, got %s", saved)
+	}
+
+	// never started
+	c, _ = newCache()
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := snapshot(); got != saved {
+		t.Fatalf("expected the snapshot to be kept, got %s", got)
+	}
+
+	// canceled before loading
+	c, _ = newCache()
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := c.Start(canceled); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := snapshot(); got != saved {
+		t.Fatalf("expected the snapshot to be kept, got %s", got)
+	}
+
+	// snapshot can't be loaded
+	if err := os.WriteFile(filepath.Join(dir, "layer-0.json"), []byte("broken"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, _ = newCache()
+	if err := c.Start(ctx); err == nil {
+		t.Fatal("expected an error loading the snapshot")
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := snapshot(); got != "broken" {
+		t.Fatalf("expected the snapshot to be kept, got %s", got)
+	}
+}
+
+// slowEnumerator is [Memory] with a Walk that waits until release is closed.
+type slowEnumerator struct {
+	*Memory
+	walking chan struct{}
+	release chan struct{}
+}
+
+func (se *slowEnumerator) Walk(ctx context.Context, fn func(StoredItem) error) error {
+	close(se.walking)
+	<-se.release
+	return se.Memory.Walk(ctx, fn)
+}
+
+func TestStartServesWhileRestoring(t *testing.T) {
+	ctx := context.Background()
+	se := &slowEnumerator{
+		Memory:  NewMemory(),
+		walking: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	c := NewWithOptions(NewMemory(), []*Layer{NewLayer(se)}, WithSnapshots(t.TempDir(), 0))
+	h, err := c.Handle(testVariant(t, c).imageType, testOptions)
+	if err != nil {
+		t.Skip(err)
+	}
+	started := make(chan error)
+	go func() {
+		started <- c.Start(ctx)
+	}()
+	<-se.walking
+
+	answered := make(chan int)
+	go func() {
+		answered <- get(h, "missing.png", nil).Code
+	}()
+	select {
+	case code := <-answered:
+		if code != http.StatusNotFound {
+			t.Fatalf("expected 404, got %d", code)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("request was not answered while the layers were restored")
+	}
+
+	close(se.release)
+	if err := <-started; err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
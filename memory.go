@@ -3,13 +3,18 @@ package imagecache
 import (
 	"context"
 	"errors"
+	"fmt"
+	"hash/fnv"
 	"sync"
+	"time"
 )
 
 // Memory can be used as a [Storer] or [Cacher].
 type Memory struct {
-	data map[string][]byte
-	lock sync.RWMutex
+	data     map[string][]byte
+	metadata map[string]Metadata
+	versions map[string]SourceVersion
+	lock     sync.RWMutex
 }
 
 // ErrNotInMemory is returned if an item does not exists in [Memory]
@@ -18,19 +23,41 @@ var ErrNotInMemory = errors.New("does not exist in memory cache")
 // compile-time check
 var _ Storer = &Memory{}
 var _ Cacher = &Memory{}
+var _ Versioner = &Memory{}
+var _ EntryCacher = &Memory{}
+var _ Enumerator = &Memory{}
 
 // NewMemory creates a new in-memory [Storer] or [Cacher]
 func NewMemory() *Memory {
 	return &Memory{
-		data: make(map[string][]byte),
+		data:     make(map[string][]byte),
+		metadata: make(map[string]Metadata),
+		versions: make(map[string]SourceVersion),
 	}
 }
 
 // Put an item into Memory. It can't return an error.
-func (m *Memory) Put(_ context.Context, name string, content []byte) error {
+func (m *Memory) Put(ctx context.Context, name string, content []byte) error {
+	return m.PutEntry(ctx, name, Entry{
+		Content: content,
+	})
+}
+
+// PutEntry puts an item with its metadata into Memory. It can't return an
+// error.
+func (m *Memory) PutEntry(_ context.Context, name string, entry Entry) error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
+	content := entry.Content
 	m.data[name] = content
+	m.metadata[name] = entry.Metadata
+	hash := fnv.New64a()
+	hash.Write(content)
+	m.versions[name] = SourceVersion{
+		ModTime: time.Now(),
+		Size:    int64(len(content)),
+		ETag:    fmt.Sprintf("%x", hash.Sum(nil)),
+	}
 	return nil
 }
 
@@ -46,6 +73,21 @@ func (m *Memory) Get(_ context.Context, name string) ([]byte, error) {
 	return nil, ErrNotInMemory
 }
 
+// GetEntry gets an item with its metadata from Memory. If the item does not
+// exists it return [ErrNotInMemory] as the error.
+func (m *Memory) GetEntry(_ context.Context, name string) (Entry, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	content, exists := m.data[name]
+	if exists {
+		return Entry{
+			Content:  content,
+			Metadata: m.metadata[name],
+		}, nil
+	}
+	return Entry{}, ErrNotInMemory
+}
+
 // Checks if an item exists
 func (m *Memory) Exists(_ context.Context, name string) bool {
 	m.lock.RLock()
@@ -60,15 +102,48 @@ func (m *Memory) Delete(_ context.Context, name string) error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 	delete(m.data, name)
+	delete(m.metadata, name)
+	delete(m.versions, name)
 	return nil
 }
 
-// func (m *Memory) Stats() (count int32, size int64) {
-// 	m.lock.RLock()
-// 	defer m.lock.RUnlock()
-// 	for _, v := range m.data {
-// 		count++
-// 		size += int64(len(v))
-// 	}
-// 	return
-// }
+// Version of an item in Memory. The version is determined when the item is
+// put into Memory. If the item does not exists it return [ErrNotInMemory]
+// as the error.
+func (m *Memory) Version(_ context.Context, name string) (SourceVersion, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	version, exists := m.versions[name]
+	if exists {
+		return version, nil
+	}
+	return SourceVersion{}, ErrNotInMemory
+}
+
+// Walk calls fn for every item in Memory. The modification time of an item
+// is the time it was put into Memory. fn is called without holding a lock,
+// so it may modify Memory.
+func (m *Memory) Walk(ctx context.Context, fn func(StoredItem) error) error {
+	m.lock.RLock()
+	items := make([]StoredItem, 0, len(m.data))
+	for name, content := range m.data {
+		items = append(items, StoredItem{
+			Name:    name,
+			Size:    int64(len(content)),
+			ModTime: m.versions[name].ModTime,
+			Expires: m.metadata[name].Expires,
+			Cost:    m.metadata[name].Cost,
+		})
+	}
+	m.lock.RUnlock()
+
+	for _, item := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package imagecache
+
+import (
+	"math"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync"
+)
+
+// compile time checks
+var _ EvictionStrategy = &MemoryPressureEviction{}
+var _ Observer = &MemoryPressureEviction{}
+
+const (
+	metricTotalMemory    = "/memory/classes/total:bytes"
+	metricReleasedMemory = "/memory/classes/heap/released:bytes"
+	metricGCCycles       = "/gc/cycles/total:gc-cycles"
+)
+
+// MemoryPressureEviction evicts items of a layer over [Memory] when the
+// memory of the process approaches a limit, so the cache shrinks before the
+// process runs out of memory. The memory is measured like the Go runtime
+// does for its soft memory limit, see [debug.SetMemoryLimit]. Once the
+// memory exceeds a high fraction of the limit, items are evicted in the
+// order of the layer until it drops below a low fraction.
+//
+// Evicted items are only freed by the next garbage collection, until then
+// their size is deducted from the measured memory. The memory is measured
+// whenever the layer is checked for eviction, so use it together with
+// [Layer.BackgroundEviction] to react to pressure caused by other parts of
+// the process.
+type MemoryPressureEviction struct {
+	limit int64
+	high  float64
+	low   float64
+
+	lock sync.Mutex
+	// measure returns the memory in bytes and the garbage collection cycle,
+	// false if the memory can't be measured
+	measure func() (memory int64, cycle uint64, ok bool)
+	// bytes evicted since the garbage collection cycle
+	shed  int64
+	cycle uint64
+}
+
+// NewMemoryPressureEviction creates a new EvictionStrategy which evicts
+// items when the memory of the process exceeds high times limit, until it is
+// below low times limit. A limit of 0 uses the soft memory limit of the
+// runtime, e.g. from GOMEMLIMIT. Without any limit nothing is evicted.
+// high has to be in (0, 1] and low in (0, high], otherwise they are replaced
+// by 1 and high.
+func NewMemoryPressureEviction(limit int64, high, low float64) *MemoryPressureEviction {
+	if high <= 0 || high > 1 {
+		high = 1
+	}
+	if low <= 0 || low > high {
+		low = high
+	}
+	samples := []metrics.Sample{
+		{Name: metricTotalMemory},
+		{Name: metricReleasedMemory},
+		{Name: metricGCCycles},
+	}
+	return &MemoryPressureEviction{
+		limit: limit,
+		high:  high,
+		low:   low,
+		measure: func() (int64, uint64, bool) {
+			return readMemory(samples)
+		},
+	}
+}
+
+// readMemory returns the memory of the process in bytes and the number of
+// garbage collection cycles, false if the runtime does not support them.
+func readMemory(samples []metrics.Sample) (memory int64, cycle uint64, ok bool) {
+	metrics.Read(samples)
+	for _, s := range samples {
+		if s.Value.Kind() != metrics.KindUint64 {
+			return 0, 0, false
+		}
+	}
+	total := samples[0].Value.Uint64()
+	released := samples[1].Value.Uint64()
+	return int64(total - released), samples[2].Value.Uint64(), true
+}
+
+// memoryLimit returns the limit in bytes, or 0 if there is none.
+func (mpe *MemoryPressureEviction) memoryLimit() int64 {
+	if mpe.limit > 0 {
+		return mpe.limit
+	}
+	// a negative value only reads the limit
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		return limit
+	}
+	return 0
+}
+
+// used returns the memory in bytes that counts towards the limit, less the
+// size of items evicted since the last garbage collection. The strategy has
+// to be locked.
+func (mpe *MemoryPressureEviction) used() int64 {
+	memory, cycle, ok := mpe.measure()
+	if !ok {
+		return 0
+	}
+	if cycle != mpe.cycle {
+		mpe.cycle = cycle
+		mpe.shed = 0
+	}
+	return memory - mpe.shed
+}
+
+func (mpe *MemoryPressureEviction) Victims(view LayerView) (victims []string) {
+	limit := mpe.memoryLimit()
+	if limit <= 0 {
+		return nil
+	}
+
+	mpe.lock.Lock()
+	defer mpe.lock.Unlock()
+	used := mpe.used()
+	if float64(used) <= mpe.high*float64(limit) {
+		return nil
+	}
+	bytes := used - int64(mpe.low*float64(limit))
+	view.Range(func(i ItemInfo) bool {
+		victims = append(victims, i.Name)
+		bytes -= i.Size
+		return bytes > 0
+	})
+	return
+}
+
+func (mpe *MemoryPressureEviction) Observe(ItemInfo) {}
+
+// Forget counts the size of evicted items, until the next garbage
+// collection frees them.
+func (mpe *MemoryPressureEviction) Forget(i ItemInfo, evicted bool) {
+	if !evicted {
+		return
+	}
+	mpe.lock.Lock()
+	defer mpe.lock.Unlock()
+	mpe.shed += i.Size
+}
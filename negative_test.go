@@ -0,0 +1,30 @@
+package imagecache
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNegativeCacheStore(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestCache(t, WithNegativeCache(time.Minute, 10))
+	h, err := c.Handle(testVariant(t, c).imageType, testOptions)
+	if err != nil {
+		t.Skip(err)
+	}
+	if w := get(h, "cat.png", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	if _, missing := c.negative.get("cat.png"); !missing {
+		t.Fatal("expected missing original to be remembered")
+	}
+
+	if err := c.Store(ctx, "cat.png", testImage(t)); err != nil {
+		t.Fatal(err)
+	}
+	if _, missing := c.negative.get("cat.png"); missing {
+		t.Fatal("expected stored original to be forgotten")
+	}
+}
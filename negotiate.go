@@ -0,0 +1,83 @@
+package imagecache
+
+import (
+	"strconv"
+	"strings"
+)
+
+// acceptRange is a single media range of an Accept header.
+type acceptRange struct {
+	mediaType string
+	subType   string
+	q         float64
+}
+
+// parseAccept parses the media ranges of an Accept header. Malformed ranges
+// are ignored.
+func parseAccept(header string) []acceptRange {
+	ranges := make([]acceptRange, 0, 8)
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		mediaType, subType, ok := strings.Cut(strings.TrimSpace(params[0]), "/")
+		if !ok || mediaType == "" || subType == "" {
+			continue
+		}
+		ar := acceptRange{
+			mediaType: strings.ToLower(mediaType),
+			subType:   strings.ToLower(subType),
+			q:         1,
+		}
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if !strings.EqualFold(key, "q") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(value, 64); err == nil && q >= 0 && q <= 1 {
+				ar.q = q
+			}
+		}
+		ranges = append(ranges, ar)
+	}
+	return ranges
+}
+
+// quality returns the quality value the ranges assign to contentType. The
+// most specific matching range wins, 0 means not acceptable.
+func quality(ranges []acceptRange, contentType string) float64 {
+	mediaType, subType, _ := strings.Cut(contentType, "/")
+	q, specificity := 0.0, -1
+	for _, ar := range ranges {
+		s := -1
+		switch {
+		case ar.mediaType == mediaType && ar.subType == subType:
+			s = 2
+		case ar.mediaType == mediaType && ar.subType == "*":
+			s = 1
+		case ar.mediaType == "*" && ar.subType == "*":
+			s = 0
+		}
+		if s > specificity {
+			q, specificity = ar.q, s
+		}
+	}
+	return q
+}
+
+// negotiate picks the variant with the highest quality value according to
+// the Accept header. Ties are resolved by the order of variants. Without an
+// Accept header every variant is acceptable. Returns nil if none of the
+// variants is acceptable.
+func negotiate(header string, variants []*variant) *variant {
+	if strings.TrimSpace(header) == "" {
+		return variants[0]
+	}
+	ranges := parseAccept(header)
+	var best *variant
+	bestQ := 0.0
+	for _, v := range variants {
+		if q := quality(ranges, v.contentType); q > bestQ {
+			best, bestQ = v, q
+		}
+	}
+	return best
+}
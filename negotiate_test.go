@@ -0,0 +1,68 @@
+package imagecache
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/h2non/bimg"
+)
+
+func TestNegotiate(t *testing.T) {
+	avif := &variant{contentType: "image/avif"}
+	webp := &variant{contentType: "image/webp"}
+	jpeg := &variant{contentType: "image/jpeg"}
+	variants := []*variant{avif, webp, jpeg}
+
+	tests := []struct {
+		accept string
+		want   *variant
+	}{
+		{"", avif},
+		{"image/avif,image/webp,image/apng,image/*,*/*;q=0.8", avif},
+		{"image/webp,*/*;q=0.8", webp},
+		{"image/webp;q=0.5,image/jpeg", jpeg},
+		{"image/*;q=0.8,image/avif;q=0", webp},
+		{"text/html", nil},
+		{"*/*;q=0", nil},
+	}
+	for _, tt := range tests {
+		if got := negotiate(tt.accept, variants); got != tt.want {
+			t.Errorf("negotiate(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestHandleNegotiated(t *testing.T) {
+	c, _ := newTestCache(t)
+	webp, err := c.newVariant(bimg.WEBP, testOptions)
+	if err != nil {
+		t.Skip(err)
+	}
+	jpeg := testVariant(t, c)
+	h, err := c.HandleNegotiated([]bimg.ImageType{bimg.WEBP, bimg.JPEG}, testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each negotiated type is cached on its own
+	seed(t, c, webp, "cat.png", []byte("webp"))
+	seed(t, c, jpeg, "cat.png", []byte("jpeg"))
+
+	tests := []struct {
+		accept string
+		code   int
+		body   string
+	}{
+		{"image/webp,*/*;q=0.8", http.StatusOK, "webp"},
+		{"image/jpeg", http.StatusOK, "jpeg"},
+		{"text/html", http.StatusNotAcceptable, ""},
+	}
+	for _, tt := range tests {
+		w := get(h, "cat.png", http.Header{"Accept": {tt.accept}})
+		if w.Code != tt.code || (tt.body != "" && w.Body.String() != tt.body) {
+			t.Errorf("%s: expected %d %q, got %d %q", tt.accept, tt.code, tt.body, w.Code, w.Body)
+		}
+		if vary := w.Header().Get("Vary"); vary != "Accept" {
+			t.Errorf("%s: expected Vary: Accept, got %q", tt.accept, vary)
+		}
+	}
+}
@@ -2,17 +2,31 @@ package imagecache
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"hash/fnv"
 	"io"
 	"io/fs"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 const alphabet = "abcdefghijklmnopqrstuvwxyz"
 const filePermission = 0776
 
+// metadataSuffix is appended to the file name of an item to store its
+// metadata.
+const metadataSuffix = ".meta"
+
+// fileMetadata is stored next to each item. The name of the item is
+// required to enumerate items, as file names are hashed.
+type fileMetadata struct {
+	Name string
+	Metadata
+}
+
 type NestedFileSystem struct {
 	path    string
 	numSubs uint
@@ -21,6 +35,9 @@ type NestedFileSystem struct {
 // compile-time check
 var _ Storer = &NestedFileSystem{}
 var _ Cacher = &NestedFileSystem{}
+var _ Versioner = &NestedFileSystem{}
+var _ EntryCacher = &NestedFileSystem{}
+var _ Enumerator = &NestedFileSystem{}
 
 func NewNestedFilesystem(path string, numSubdirectories uint) (*NestedFileSystem, error) {
 	stat, err := os.Stat(path)
@@ -62,23 +79,53 @@ func (nfs *NestedFileSystem) calculatePath(name string) string {
 	return fmt.Sprintf("%s/%x", nfs.path, hashedName)
 }
 
-func (nfs *NestedFileSystem) Put(_ context.Context, name string, content []byte) error {
+func (nfs *NestedFileSystem) Put(ctx context.Context, name string, content []byte) error {
+	return nfs.PutEntry(ctx, name, Entry{
+		Content: content,
+	})
+}
+
+// PutEntry writes the content of an item and its metadata in a separate file
+// next to it. The metadata is written first, so content never exists without
+// it, which would make it untracked. Both are removed if a write fails.
+func (nfs *NestedFileSystem) PutEntry(_ context.Context, name string, entry Entry) error {
 	fn := nfs.calculatePath(name)
+	metadata, err := json.Marshal(fileMetadata{
+		Name:     name,
+		Metadata: entry.Metadata,
+	})
+	if err != nil {
+		return err
+	}
+	err = nfs.write(fn+metadataSuffix, metadata)
+	if err == nil {
+		err = nfs.write(fn, entry.Content)
+	}
+	if err != nil {
+		os.Remove(fn)                  //nolint:errcheck
+		os.Remove(fn + metadataSuffix) //nolint:errcheck
+		return err
+	}
+	return nil
+}
+
+func (nfs *NestedFileSystem) write(fn string, content []byte) error {
 	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, filePermission)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
 	n, err := f.Write(content)
 	if err != nil {
+		f.Close() //nolint:errcheck
 		return err
 	}
 	if n != len(content) {
+		f.Close() //nolint:errcheck
 		return fmt.Errorf("expected %d bytes to be written, but only %d were", len(content), n)
 	}
 
-	return nil
+	return f.Close()
 }
 
 func (nfs *NestedFileSystem) Get(_ context.Context, name string) ([]byte, error) {
@@ -91,6 +138,31 @@ func (nfs *NestedFileSystem) Get(_ context.Context, name string) ([]byte, error)
 	return io.ReadAll(f)
 }
 
+// GetEntry reads the content of an item and its metadata. Items without a
+// metadata file have empty metadata.
+func (nfs *NestedFileSystem) GetEntry(ctx context.Context, name string) (Entry, error) {
+	content, err := nfs.Get(ctx, name)
+	if err != nil {
+		return Entry{}, err
+	}
+	entry := Entry{
+		Content: content,
+	}
+	metadata, err := os.ReadFile(nfs.calculatePath(name) + metadataSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return entry, nil
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+	var fm fileMetadata
+	if err := json.Unmarshal(metadata, &fm); err != nil {
+		return Entry{}, err
+	}
+	entry.Metadata = fm.Metadata
+	return entry, nil
+}
+
 func (nfs *NestedFileSystem) exists(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil
@@ -100,17 +172,116 @@ func (nfs *NestedFileSystem) Exists(_ context.Context, name string) bool {
 	return nfs.exists(nfs.calculatePath(name))
 }
 
+// Version reports the modification time and size of a file.
+func (nfs *NestedFileSystem) Version(_ context.Context, name string) (SourceVersion, error) {
+	stat, err := os.Stat(nfs.calculatePath(name))
+	if err != nil {
+		return SourceVersion{}, err
+	}
+	return SourceVersion{
+		ModTime: stat.ModTime(),
+		Size:    stat.Size(),
+	}, nil
+}
+
 func (nfs *NestedFileSystem) Delete(_ context.Context, name string) error {
-	return os.Remove(nfs.calculatePath(name))
-}
-
-// func (nfs *NestedFileSystem) Stats() (count int32, size int64) {
-// 	filepath.Walk(nfs.path, func(_ string, info fs.FileInfo, err error) error { //nolint:errcheck
-// 		if err == nil && !info.IsDir() {
-// 			count++
-// 			size += info.Size()
-// 		}
-// 		return nil
-// 	})
-// 	return
-// }
+	fn := nfs.calculatePath(name)
+	if err := os.Remove(fn); err != nil {
+		return err
+	}
+	if err := os.Remove(fn + metadataSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Walk calls fn for every item. Files without metadata file, e.g. written
+// by older versions, are reported with an empty name because their names
+// are unknown.
+func (nfs *NestedFileSystem) Walk(ctx context.Context, fn func(StoredItem) error) error {
+	return filepath.WalkDir(nfs.path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if !strings.HasSuffix(path, metadataSuffix) {
+			return nfs.walkUntracked(path, d, fn)
+		}
+
+		metadata, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var fm fileMetadata
+		if err := json.Unmarshal(metadata, &fm); err != nil || fm.Name == "" {
+			// not written by us
+			return nil
+		}
+		stat, err := os.Stat(strings.TrimSuffix(path, metadataSuffix))
+		if errors.Is(err, fs.ErrNotExist) {
+			// orphaned metadata
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(StoredItem{
+			Name:    fm.Name,
+			Size:    stat.Size(),
+			ModTime: stat.ModTime(),
+			Expires: fm.Metadata.Expires,
+			Cost:    fm.Metadata.Cost,
+		})
+	})
+}
+
+// walkUntracked calls fn for the content file at path if it has no metadata
+// file. Content files with metadata are reported with their metadata.
+func (nfs *NestedFileSystem) walkUntracked(path string, d fs.DirEntry, fn func(StoredItem) error) error {
+	if nfs.exists(path + metadataSuffix) {
+		return nil
+	}
+	info, err := d.Info()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fn(StoredItem{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	})
+}
+
+// RemoveUntracked deletes all files without metadata file and returns the
+// number of bytes freed. Only use it if the directory contains nothing but
+// cached items, as originals written by older versions have no metadata
+// file either.
+func (nfs *NestedFileSystem) RemoveUntracked(ctx context.Context) (int64, error) {
+	var freed int64
+	err := filepath.WalkDir(nfs.path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, metadataSuffix) {
+			return nil
+		}
+		return nfs.walkUntracked(path, d, func(si StoredItem) error {
+			if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			freed += si.Size
+			return nil
+		})
+	})
+	return freed, err
+}
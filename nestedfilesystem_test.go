@@ -1,8 +1,10 @@
 package imagecache
 
 import (
+	"context"
 	"hash/fnv"
 	"math/rand"
+	"os"
 	"testing"
 	"time"
 )
@@ -63,3 +65,150 @@ func BenchmarkFNV32(b *testing.B) {
 		}
 	})
 }
+
+func TestNestedFileSystemRebuild(t *testing.T) {
+	ctx := context.Background()
+	nfs, err := NewNestedFilesystem(t.TempDir(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := map[string]string{
+		"a": "1",
+		"b": "22",
+		"c": "333",
+	}
+	for name, content := range items {
+		if err := nfs.Put(ctx, name, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a fresh layer over existing items, like after a restart
+	l := NewLayer(nfs)
+	if err := l.Rebuild(ctx); err != nil {
+		t.Fatal(err)
+	}
+	stats := l.Stats()
+	if stats.Count != 3 || stats.Size != 6 {
+		t.Fatalf("expected 3 items with 6 bytes, got %+v", stats)
+	}
+
+	if err := nfs.Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	found := 0
+	err = nfs.Walk(ctx, func(si StoredItem) error {
+		found++
+		if items[si.Name] == "" || int64(len(items[si.Name])) != si.Size {
+			t.Errorf("unexpected item %+v", si)
+		}
+		return nil
+	})
+	if err != nil || found != 2 {
+		t.Fatalf("expected to find 2 items, found %d: %v", found, err)
+	}
+}
+
+func TestNestedFileSystemMetadata(t *testing.T) {
+	ctx := context.Background()
+	nfs, err := NewNestedFilesystem(t.TempDir(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	entry := Entry{
+		Content: []byte("variant"),
+		Metadata: Metadata{
+			Created:       created,
+			SourceVersion: "1a.2b",
+			ContentType:   "image/webp",
+			Width:         300,
+			Height:        200,
+			Expires:       created.Add(time.Hour),
+			Cost:          250 * time.Millisecond,
+		},
+	}
+	if err := nfs.PutEntry(ctx, "photos/cat.jpg", entry); err != nil {
+		t.Fatal(err)
+	}
+	got, err := nfs.GetEntry(ctx, "photos/cat.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Content) != "variant" || got.Metadata != entry.Metadata {
+		t.Fatalf("expected %+v, got %+v", entry, got)
+	}
+
+	// items written by Put have empty metadata
+	if err := nfs.Put(ctx, "plain", []byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := nfs.GetEntry(ctx, "plain"); err != nil || got.Metadata != (Metadata{}) {
+		t.Fatalf("expected empty metadata, got %+v, %v", got.Metadata, err)
+	}
+}
+
+func TestNestedFileSystemUntracked(t *testing.T) {
+	ctx := context.Background()
+	nfs, err := NewNestedFilesystem(t.TempDir(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nfs.Put(ctx, "tracked", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	// written by an older version, without metadata file
+	if err := os.WriteFile(nfs.calculatePath("legacy"), []byte("legacy"), filePermission); err != nil {
+		t.Fatal(err)
+	}
+
+	// the untracked content alone exceeds the limit
+	l := NewLayer(nfs, NewMaxCacheSizeEviction(3))
+	if err := l.Rebuild(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if stats := l.Stats(); stats.Count != 1 || stats.Size != 1 || stats.Untracked != 6 {
+		t.Fatalf("expected 1 item with 1 byte, 6 untracked, got %+v", stats)
+	}
+	l.Put(ctx, "new", []byte("2")) //nolint:errcheck
+	l.Wait(ctx)                    //nolint:errcheck
+	if stats := l.Stats(); stats.Count != 2 {
+		t.Fatalf("expected untracked content not to evict tracked items, got %+v", stats)
+	}
+
+	freed, err := nfs.RemoveUntracked(ctx)
+	if err != nil || freed != 6 {
+		t.Fatalf("expected 6 bytes to be freed, got %d: %v", freed, err)
+	}
+	if nfs.Exists(ctx, "legacy") || !nfs.Exists(ctx, "tracked") || !nfs.Exists(ctx, "new") {
+		t.Fatal("expected only the untracked file to be removed")
+	}
+	if err := l.Rebuild(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if stats := l.Stats(); stats.Count != 2 || stats.Size != 2 || stats.Untracked != 0 {
+		t.Fatalf("expected 2 items with 2 bytes, got %+v", stats)
+	}
+}
+
+func TestNestedFileSystemFailedPut(t *testing.T) {
+	ctx := context.Background()
+	nfs, err := NewNestedFilesystem(t.TempDir(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the content can't be written
+	fn := nfs.calculatePath("broken")
+	if err := os.Mkdir(fn, filePermission); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fn+"/child", nil, filePermission); err != nil {
+		t.Fatal(err)
+	}
+	if err := nfs.Put(ctx, "broken", []byte("content")); err == nil {
+		t.Fatal("expected the put to fail")
+	}
+	if nfs.exists(fn + metadataSuffix) {
+		t.Fatal("expected the metadata to be removed")
+	}
+}
@@ -0,0 +1,72 @@
+package imagecache
+
+import "time"
+
+// Option configures optional behavior of a [Cache].
+type Option func(*Cache)
+
+// WithNegativeCache remembers originals that do not exist in the [Storer]
+// for ttl, so repeated requests for them don't reach the [Storer]. At most
+// maxEntries names are remembered, 0 means no limit. Names are forgotten
+// when they are stored with [Cache.Store] or cleared with
+// [Cache.ClearSource].
+func WithNegativeCache(ttl time.Duration, maxEntries int) Option {
+	return func(c *Cache) {
+		c.negative = newExpiringCache[struct{}](ttl, maxEntries)
+	}
+}
+
+// DefaultVersionCheckInterval is the time versions of originals are
+// remembered if not configured otherwise with [WithVersionCheck].
+const DefaultVersionCheckInterval = 10 * time.Second
+
+// defaultVersionEntries is the number of versions remembered by default.
+const defaultVersionEntries = 10000
+
+// WithVersionCheck configures how often the version of an original is
+// looked up in a [Storer] that implements [Versioner]. Versions are
+// remembered for interval, so changes of originals are noticed after at most
+// interval unless they are stored with [Cache.Store] or cleared with
+// [Cache.ClearSource]. At most maxEntries versions are remembered, 0 means no
+// limit. An interval of 0 looks up the version on every request, including
+// cache hits.
+func WithVersionCheck(interval time.Duration, maxEntries int) Option {
+	return func(c *Cache) {
+		c.versions = newExpiringCache[SourceVersion](interval, maxEntries)
+	}
+}
+
+// WithWriteBack configures the queue that writes new variants to the layers
+// in the background. Without it [DefaultWriteBackConfig] is used.
+func WithWriteBack(config WriteBackConfig) Option {
+	return func(c *Cache) {
+		c.wbConfig = config
+	}
+}
+
+// WithBackgroundEviction checks all layers for items to evict every
+// interval, once the cache is started with [Cache.Start].
+func WithBackgroundEviction(interval time.Duration) Option {
+	return func(c *Cache) {
+		c.evictionInterval = interval
+	}
+}
+
+// WithKeyFunc replaces [CanonicalKey] as the function that calculates the
+// cache keys of variants.
+func WithKeyFunc(fn KeyFunc) Option {
+	return func(c *Cache) {
+		c.keyFunc = fn
+	}
+}
+
+// WithSnapshots persists the state of all layers to files in dir, so the
+// order of accesses survives restarts. Snapshots are loaded by [Cache.Start],
+// saved every interval and once more by [Cache.Close]. The file of each layer
+// is named by its index, so the order of layers must not change.
+func WithSnapshots(dir string, interval time.Duration) Option {
+	return func(c *Cache) {
+		c.snapshotDir = dir
+		c.snapshotInterval = interval
+	}
+}
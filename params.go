@@ -0,0 +1,306 @@
+package imagecache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/h2non/bimg"
+)
+
+// ErrInvalidParams is returned if transformation parameters from a URL
+// can't be parsed or are outside of the configured [ParamLimits].
+var ErrInvalidParams = errors.New("invalid transformation parameters")
+
+// Params are the transformation parameters that can be requested by URL.
+type Params struct {
+	Width   int
+	Height  int
+	Crop    bool
+	Quality int
+	Type    bimg.ImageType
+	Gravity bimg.Gravity
+}
+
+// ParamLimits bound the transformation parameters that are accepted from
+// URLs. A zero value for a maximum means there is no limit.
+type ParamLimits struct {
+	MaxWidth   int
+	MaxHeight  int
+	MinQuality int
+	MaxQuality int
+	// Types are the output formats that may be requested. The first one is
+	// used if no format is requested.
+	Types []bimg.ImageType
+}
+
+// DefaultParamLimits returns limits that allow images up to 4096x4096 pixels
+// in JPEG, WebP, PNG and AVIF.
+func DefaultParamLimits() ParamLimits {
+	return ParamLimits{
+		MaxWidth:   4096,
+		MaxHeight:  4096,
+		MinQuality: 10,
+		MaxQuality: 100,
+		Types:      []bimg.ImageType{bimg.JPEG, bimg.WEBP, bimg.PNG, bimg.AVIF},
+	}
+}
+
+var gravities = map[string]bimg.Gravity{
+	"ce": bimg.GravityCentre,
+	"no": bimg.GravityNorth,
+	"ea": bimg.GravityEast,
+	"so": bimg.GravitySouth,
+	"we": bimg.GravityWest,
+	"sm": bimg.GravitySmart,
+}
+
+var gravityNames = map[bimg.Gravity]string{
+	bimg.GravityCentre: "ce",
+	bimg.GravityNorth:  "no",
+	bimg.GravityEast:   "ea",
+	bimg.GravitySouth:  "so",
+	bimg.GravityWest:   "we",
+	bimg.GravitySmart:  "sm",
+}
+
+// isParamSegment reports if a path segment is a transformation parameter
+// and not part of the image name.
+func isParamSegment(segment string) bool {
+	key, _, ok := strings.Cut(segment, ":")
+	if !ok {
+		return false
+	}
+	switch key {
+	case "w", "width", "h", "height", "rs", "resize", "c", "crop",
+		"q", "quality", "f", "format", "g", "gravity":
+		return true
+	}
+	return false
+}
+
+// ParseParams parses transformation parameters from the leading segments of
+// path and from query. Parameters in the path have the form key:value and
+// are separated by slashes, the first segment that is not a parameter starts
+// the image name, which is returned alongside the parameters.
+//
+//	rs:300:200/q:80/f:webp/photos/cat.jpg
+//	c:300:300/g:sm/photos/cat.jpg
+//	photos/cat.jpg?w=300&h=200&crop=true&format=webp
+//
+// The keys are w (width), h (height), rs (resize, width and height),
+// c (crop, width and height), q (quality), f (format) and g (gravity: ce, no,
+// ea, so, we or sm). Parameters in the path take precedence over the query.
+// All errors wrap [ErrInvalidParams].
+func ParseParams(path string, query url.Values, limits ParamLimits) (Params, string, error) {
+	var p Params
+	for _, key := range []string{"w", "h", "crop", "q", "format", "gravity"} {
+		if value := query.Get(key); value != "" {
+			if err := p.set(key, []string{value}); err != nil {
+				return p, "", err
+			}
+		}
+	}
+
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	i := 0
+	for ; i < len(segments) && isParamSegment(segments[i]); i++ {
+		values := strings.Split(segments[i], ":")
+		if err := p.set(values[0], values[1:]); err != nil {
+			return p, "", err
+		}
+	}
+	name := strings.Join(segments[i:], "/")
+	if name == "" {
+		return p, "", fmt.Errorf("%w: missing image name", ErrInvalidParams)
+	}
+
+	if err := p.validate(limits); err != nil {
+		return p, "", err
+	}
+	return p, name, nil
+}
+
+func (p *Params) set(key string, values []string) error {
+	ints := func(n int) ([]int, error) {
+		if len(values) != n {
+			return nil, fmt.Errorf("%w: %s expects %d values", ErrInvalidParams, key, n)
+		}
+		result := make([]int, n)
+		for i, v := range values {
+			parsed, err := strconv.Atoi(v)
+			if err != nil || parsed < 0 {
+				return nil, fmt.Errorf("%w: %s has invalid value '%s'", ErrInvalidParams, key, v)
+			}
+			result[i] = parsed
+		}
+		return result, nil
+	}
+	single := func() (string, error) {
+		if len(values) != 1 {
+			return "", fmt.Errorf("%w: %s expects 1 value", ErrInvalidParams, key)
+		}
+		return strings.ToLower(values[0]), nil
+	}
+
+	switch key {
+	case "w", "width":
+		v, err := ints(1)
+		if err != nil {
+			return err
+		}
+		p.Width = v[0]
+	case "h", "height":
+		v, err := ints(1)
+		if err != nil {
+			return err
+		}
+		p.Height = v[0]
+	case "rs", "resize", "c":
+		v, err := ints(2)
+		if err != nil {
+			return err
+		}
+		p.Width, p.Height = v[0], v[1]
+		p.Crop = key == "c"
+	case "crop":
+		// crop:w:h in the path, crop=true in the query
+		if len(values) == 1 {
+			crop, err := strconv.ParseBool(values[0])
+			if err != nil {
+				return fmt.Errorf("%w: crop has invalid value '%s'", ErrInvalidParams, values[0])
+			}
+			p.Crop = crop
+			return nil
+		}
+		v, err := ints(2)
+		if err != nil {
+			return err
+		}
+		p.Width, p.Height, p.Crop = v[0], v[1], true
+	case "q", "quality":
+		v, err := ints(1)
+		if err != nil {
+			return err
+		}
+		p.Quality = v[0]
+	case "f", "format":
+		v, err := single()
+		if err != nil {
+			return err
+		}
+		if v == "jpg" {
+			v = "jpeg"
+		}
+		p.Type = bimg.UNKNOWN
+		for t, name := range bimg.ImageTypes {
+			if name == v {
+				p.Type = t
+			}
+		}
+		if p.Type == bimg.UNKNOWN {
+			return fmt.Errorf("%w: unknown format '%s'", ErrInvalidParams, v)
+		}
+	case "g", "gravity":
+		v, err := single()
+		if err != nil {
+			return err
+		}
+		gravity, ok := gravities[v]
+		if !ok {
+			return fmt.Errorf("%w: unknown gravity '%s'", ErrInvalidParams, v)
+		}
+		p.Gravity = gravity
+	default:
+		return fmt.Errorf("%w: unknown parameter '%s'", ErrInvalidParams, key)
+	}
+	return nil
+}
+
+func (p *Params) validate(limits ParamLimits) error {
+	if limits.MaxWidth > 0 && p.Width > limits.MaxWidth {
+		return fmt.Errorf("%w: width %d exceeds %d", ErrInvalidParams, p.Width, limits.MaxWidth)
+	}
+	if limits.MaxHeight > 0 && p.Height > limits.MaxHeight {
+		return fmt.Errorf("%w: height %d exceeds %d", ErrInvalidParams, p.Height, limits.MaxHeight)
+	}
+	if p.Quality != 0 && (p.Quality < limits.MinQuality || (limits.MaxQuality > 0 && p.Quality > limits.MaxQuality)) {
+		return fmt.Errorf("%w: quality %d is out of range", ErrInvalidParams, p.Quality)
+	}
+	if p.Crop && (p.Width == 0 || p.Height == 0) {
+		return fmt.Errorf("%w: crop requires width and height", ErrInvalidParams)
+	}
+	if len(limits.Types) == 0 {
+		return fmt.Errorf("%w: no output formats allowed", ErrInvalidParams)
+	}
+	if p.Type == bimg.UNKNOWN {
+		p.Type = limits.Types[0]
+	}
+	if !slices.Contains(limits.Types, p.Type) {
+		return fmt.Errorf("%w: format %s is not allowed", ErrInvalidParams, bimg.ImageTypeName(p.Type))
+	}
+	return nil
+}
+
+// Options converts the parameters to [bimg.Options].
+func (p Params) Options() bimg.Options {
+	return bimg.Options{
+		Width:   p.Width,
+		Height:  p.Height,
+		Crop:    p.Crop,
+		Quality: p.Quality,
+		Gravity: p.Gravity,
+	}
+}
+
+// Path encodes the parameters and the image name in the form understood by
+// [ParseParams].
+func (p Params) Path(name string) string {
+	segments := make([]string, 0, 5)
+	switch {
+	case p.Crop:
+		segments = append(segments, fmt.Sprintf("c:%d:%d", p.Width, p.Height))
+	case p.Width > 0 || p.Height > 0:
+		segments = append(segments, fmt.Sprintf("rs:%d:%d", p.Width, p.Height))
+	}
+	if p.Quality > 0 {
+		segments = append(segments, fmt.Sprintf("q:%d", p.Quality))
+	}
+	if p.Gravity != bimg.GravityCentre {
+		segments = append(segments, "g:"+gravityNames[p.Gravity])
+	}
+	if p.Type != bimg.UNKNOWN {
+		segments = append(segments, "f:"+bimg.ImageTypeName(p.Type))
+	}
+	return strings.Join(append(segments, strings.TrimPrefix(name, "/")), "/")
+}
+
+// HandleParams creates a [Handler] that takes the transformation from the
+// name and the query of the request, see [ParseParams] for the grammar. The
+// name passed to the handler has to contain the parameter segments. Requests
+// with parameters outside of limits are answered with 400 Bad Request.
+// Variants are cached just like variants of handlers created by
+// [Cache.Handle].
+func (c *Cache) HandleParams(limits ParamLimits) Handler {
+	return func(name string, w http.ResponseWriter, r *http.Request) {
+		c.serveParams(name, r.URL.Query(), limits, w, r)
+	}
+}
+
+func (c *Cache) serveParams(path string, query url.Values, limits ParamLimits, w http.ResponseWriter, r *http.Request) {
+	p, name, err := ParseParams(path, query, limits)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	v, err := c.newVariant(p.Type, p.Options())
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	c.serve(v, name, w, r)
+}
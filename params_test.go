@@ -0,0 +1,89 @@
+package imagecache
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/h2non/bimg"
+)
+
+func TestParseParams(t *testing.T) {
+	limits := DefaultParamLimits()
+	tests := []struct {
+		path  string
+		query string
+		want  Params
+		name  string
+	}{
+		{"photos/cat.jpg", "", Params{Type: bimg.JPEG}, "photos/cat.jpg"},
+		{"rs:300:200/q:80/f:webp/photos/cat.jpg", "", Params{Width: 300, Height: 200, Quality: 80, Type: bimg.WEBP}, "photos/cat.jpg"},
+		{"/c:100:100/g:sm/cat.jpg", "", Params{Width: 100, Height: 100, Crop: true, Type: bimg.JPEG, Gravity: bimg.GravitySmart}, "cat.jpg"},
+		{"cat.jpg", "w=300&h=200&crop=true&format=png", Params{Width: 300, Height: 200, Crop: true, Type: bimg.PNG}, "cat.jpg"},
+		{"w:50/cat.jpg", "w=300", Params{Width: 50, Type: bimg.JPEG}, "cat.jpg"},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		p, name, err := ParseParams(tt.path, query, limits)
+		if err != nil {
+			t.Errorf("ParseParams(%q, %q) failed: %v", tt.path, tt.query, err)
+			continue
+		}
+		if p != tt.want || name != tt.name {
+			t.Errorf("ParseParams(%q, %q) = %+v, %q, want %+v, %q", tt.path, tt.query, p, name, tt.want, tt.name)
+		}
+		// the encoded path has to result in the same parameters
+		again, againName, err := ParseParams(p.Path(name), nil, limits)
+		if err != nil || again != p || againName != name {
+			t.Errorf("round trip of %q failed: %+v, %q, %v", p.Path(name), again, againName, err)
+		}
+	}
+}
+
+func TestParseParamsInvalid(t *testing.T) {
+	limits := DefaultParamLimits()
+	for _, path := range []string{
+		"rs:300:200",
+		"w:99999/cat.jpg",
+		"q:1/cat.jpg",
+		"f:bmp/cat.jpg",
+		"f:gif/cat.jpg",
+		"g:up/cat.jpg",
+		"rs:300/cat.jpg",
+		"c:300:0/cat.jpg",
+		"w:-1/cat.jpg",
+	} {
+		if _, _, err := ParseParams(path, nil, limits); !errors.Is(err, ErrInvalidParams) {
+			t.Errorf("expected %q to be invalid, got %v", path, err)
+		}
+	}
+}
+
+func TestHandleParams(t *testing.T) {
+	c, _ := newTestCache(t)
+	p := Params{Width: 300, Type: bimg.JPEG}
+	fixed, err := c.Handle(p.Type, bimg.Options{Width: 300})
+	if err != nil {
+		t.Skip(err)
+	}
+	v, _ := c.newVariant(p.Type, p.Options())
+	seed(t, c, v, "cat.png", []byte("variant"))
+	h := c.HandleParams(DefaultParamLimits())
+
+	// served from the same cache entry as the fixed handler
+	for name, h := range map[string]Handler{p.Path("cat.png"): h, "cat.png": fixed} {
+		if w := get(h, name, nil); w.Code != http.StatusOK || w.Body.String() != "variant" {
+			t.Errorf("expected cached variant for %s, got %d %q", name, w.Code, w.Body)
+		}
+	}
+	if stats := c.layers[0].Stats(); stats.Count != 1 {
+		t.Errorf("expected a single cached variant, got %+v", stats)
+	}
+
+	for _, name := range []string{"w:99999/cat.png", "f:bmp/cat.png"} {
+		if w := get(h, name, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d", name, w.Code)
+		}
+	}
+}
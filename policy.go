@@ -0,0 +1,225 @@
+package imagecache
+
+import "github.com/TheHippo/imagecache/list"
+
+// ReplacementPolicy orders the items of a [Layer] by the order in which they
+// should be evicted. [EvictionStrategy] implementations see the items in
+// this order. A policy is only used by a single layer, which calls it while
+// holding its lock, so it does not need to be safe for concurrent use.
+type ReplacementPolicy interface {
+	// Touch is called when the item name is put into the layer or read.
+	Touch(name string)
+	// Restore adds the item name as the next item to evict, while the state
+	// of the layer is restored, e.g. after a restart.
+	Restore(name string)
+	// Evict is called when the item name was evicted from the layer.
+	Evict(name string)
+	// Remove is called when the item name was deleted from the layer, e.g.
+	// because it became invalid.
+	Remove(name string)
+	// Range calls fn for all items in the order they should be evicted,
+	// until fn returns false. It must not modify the policy.
+	Range(fn func(name string) bool)
+}
+
+// compile time checks
+var _ ReplacementPolicy = &LRUPolicy{}
+var _ ReplacementPolicy = &ARCPolicy{}
+
+// LRUPolicy evicts the least recently used items first. It is the default
+// policy of a [Layer].
+type LRUPolicy struct {
+	order *list.List[string]
+	items map[string]*list.Element[string]
+}
+
+// NewLRUPolicy creates a new least recently used [ReplacementPolicy].
+func NewLRUPolicy() *LRUPolicy {
+	return &LRUPolicy{
+		order: list.NewList[string](),
+		items: make(map[string]*list.Element[string]),
+	}
+}
+
+func (lru *LRUPolicy) Touch(name string) {
+	if e, ok := lru.items[name]; ok {
+		lru.order.MoveToFront(e)
+		return
+	}
+	lru.items[name] = lru.order.PushFront(name)
+}
+
+func (lru *LRUPolicy) Restore(name string) {
+	if _, ok := lru.items[name]; ok {
+		return
+	}
+	lru.items[name] = lru.order.PushBack(name)
+}
+
+func (lru *LRUPolicy) Evict(name string) {
+	lru.Remove(name)
+}
+
+func (lru *LRUPolicy) Remove(name string) {
+	if e, ok := lru.items[name]; ok {
+		lru.order.Remove(e)
+		delete(lru.items, name)
+	}
+}
+
+func (lru *LRUPolicy) Range(fn func(name string) bool) {
+	for e := lru.order.Back(); e != nil; e = e.Prev() {
+		if !fn(e.Value) {
+			return
+		}
+	}
+}
+
+// arcList identifies the lists of [ARCPolicy].
+type arcList int
+
+const (
+	// arcT1 holds items that were used once recently.
+	arcT1 arcList = iota
+	// arcT2 holds items that were used at least twice recently.
+	arcT2
+	// arcB1 remembers items recently evicted from arcT1.
+	arcB1
+	// arcB2 remembers items recently evicted from arcT2.
+	arcB2
+)
+
+type arcEntry struct {
+	list    arcList
+	element *list.Element[string]
+}
+
+// ARCPolicy is an adaptive replacement cache policy. It balances between
+// items that were used recently and items that are used frequently, and
+// resists scans over items that are used only once. Items evicted before are
+// remembered in ghost lists, which adapt the balance over time.
+//
+// ARC is designed for a cache of a fixed number of items, so it should be
+// combined with a [MaxItemsEviction] of the same capacity.
+type ARCPolicy struct {
+	capacity int
+	// target size of arcT1
+	p       int
+	lists   [4]*list.List[string]
+	entries map[string]arcEntry
+}
+
+// NewARCPolicy creates a new adaptive replacement [ReplacementPolicy] for a
+// layer of capacity items.
+func NewARCPolicy(capacity int) *ARCPolicy {
+	if capacity < 1 {
+		capacity = 1
+	}
+	arc := &ARCPolicy{
+		capacity: capacity,
+		entries:  make(map[string]arcEntry),
+	}
+	for i := range arc.lists {
+		arc.lists[i] = list.NewList[string]()
+	}
+	return arc
+}
+
+func (arc *ARCPolicy) len(l arcList) int {
+	return arc.lists[l].Len()
+}
+
+// move name to the front of list l.
+func (arc *ARCPolicy) move(name string, l arcList) {
+	if e, ok := arc.entries[name]; ok {
+		arc.lists[e.list].Remove(e.element)
+	}
+	arc.entries[name] = arcEntry{
+		list:    l,
+		element: arc.lists[l].PushFront(name),
+	}
+}
+
+func (arc *ARCPolicy) forget(name string) {
+	if e, ok := arc.entries[name]; ok {
+		arc.lists[e.list].Remove(e.element)
+		delete(arc.entries, name)
+	}
+}
+
+func (arc *ARCPolicy) Touch(name string) {
+	e, ok := arc.entries[name]
+	switch {
+	case !ok:
+		arc.move(name, arcT1)
+		arc.trimGhosts()
+	case e.list == arcT1 || e.list == arcT2:
+		arc.move(name, arcT2)
+	case e.list == arcB1:
+		// evicted from the recent items too early, favor them
+		arc.p = min(arc.capacity, arc.p+max(arc.len(arcB2)/max(arc.len(arcB1), 1), 1))
+		arc.move(name, arcT2)
+	case e.list == arcB2:
+		// evicted from the frequent items too early, favor them
+		arc.p = max(0, arc.p-max(arc.len(arcB1)/max(arc.len(arcB2), 1), 1))
+		arc.move(name, arcT2)
+	}
+}
+
+func (arc *ARCPolicy) Restore(name string) {
+	if _, ok := arc.entries[name]; ok {
+		return
+	}
+	arc.entries[name] = arcEntry{
+		list:    arcT1,
+		element: arc.lists[arcT1].PushBack(name),
+	}
+}
+
+// Evict remembers name in a ghost list.
+func (arc *ARCPolicy) Evict(name string) {
+	e, ok := arc.entries[name]
+	if !ok {
+		return
+	}
+	switch e.list {
+	case arcT1:
+		arc.move(name, arcB1)
+	case arcT2:
+		arc.move(name, arcB2)
+	}
+	arc.trimGhosts()
+}
+
+// Remove forgets name without remembering it in a ghost list, as it was not
+// evicted.
+func (arc *ARCPolicy) Remove(name string) {
+	arc.forget(name)
+}
+
+// trimGhosts keeps the ghost lists within the capacity.
+func (arc *ARCPolicy) trimGhosts() {
+	for arc.len(arcT1)+arc.len(arcB1) > arc.capacity && arc.len(arcB1) > 0 {
+		arc.forget(arc.lists[arcB1].Back().Value)
+	}
+	for arc.len(arcB1)+arc.len(arcB2) > arc.capacity && arc.len(arcB2) > 0 {
+		arc.forget(arc.lists[arcB2].Back().Value)
+	}
+	for arc.len(arcB1)+arc.len(arcB2) > arc.capacity {
+		arc.forget(arc.lists[arcB1].Back().Value)
+	}
+}
+
+func (arc *ARCPolicy) Range(fn func(name string) bool) {
+	first, second := arcT2, arcT1
+	if arc.len(arcT1) > 0 && arc.len(arcT1) >= arc.p {
+		first, second = arcT1, arcT2
+	}
+	for _, l := range []arcList{first, second} {
+		for e := arc.lists[l].Back(); e != nil; e = e.Prev() {
+			if !fn(e.Value) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package imagecache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/h2non/bimg"
+)
+
+// ErrPresetExists is returned when registering a preset with a name that is
+// already taken.
+var ErrPresetExists = errors.New("preset already exists")
+
+// Preset is a named combination of output format and transformation.
+type Preset struct {
+	Type    bimg.ImageType
+	Options bimg.Options
+	// MaxAge is the time after which a cached variant is outdated and
+	// created again. 0 means variants never get outdated.
+	MaxAge time.Duration
+	// StaleWhileRevalidate is the time an outdated variant is still served
+	// while a fresh variant is created in the background. The time starts
+	// when the variant is outdated by MaxAge or when the original changed.
+	// 0 means requests wait for the fresh variant.
+	StaleWhileRevalidate time.Duration
+	// TTL is the time after which cached variants are removed from the
+	// layers, no matter how often they are accessed. It takes precedence
+	// over the ttl of a [TTLEviction]. 0 means the default of the layers.
+	TTL time.Duration
+}
+
+// PresetStats contains information about the requests served for a preset
+//   - Hits: served from one of the layers
+//   - Misses: not found in any layer
+//   - Errors: failed with an internal error
+type PresetStats struct {
+	Hits   uint64
+	Misses uint64
+	Errors uint64
+}
+
+// RegisterPreset adds a preset to the registry of the cache. Names must not
+// be empty or contain slashes. The preset name is part of the cache key of
+// its variants. Returns [ErrPresetExists] if the name is already taken.
+func (c *Cache) RegisterPreset(name string, p Preset) error {
+	if name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid preset name '%s'", name)
+	}
+	v, err := c.newVariant(p.Type, p.Options)
+	if err != nil {
+		return err
+	}
+	v.preset = name
+	v.maxAge = p.MaxAge
+	v.staleWindow = p.StaleWhileRevalidate
+	v.ttl = p.TTL
+
+	c.presetsLock.Lock()
+	defer c.presetsLock.Unlock()
+	if _, exists := c.presets[name]; exists {
+		return fmt.Errorf("%w: %s", ErrPresetExists, name)
+	}
+	c.presets[name] = v
+	return nil
+}
+
+func (c *Cache) preset(name string) (*variant, bool) {
+	c.presetsLock.RLock()
+	defer c.presetsLock.RUnlock()
+	v, ok := c.presets[name]
+	return v, ok
+}
+
+// Presets returns the sorted names of all registered presets.
+func (c *Cache) Presets() []string {
+	c.presetsLock.RLock()
+	names := make([]string, 0, len(c.presets))
+	for name := range c.presets {
+		names = append(names, name)
+	}
+	c.presetsLock.RUnlock()
+	slices.Sort(names)
+	return names
+}
+
+// Preset looks up a registered preset by name.
+func (c *Cache) Preset(name string) (Preset, bool) {
+	v, ok := c.preset(name)
+	if !ok {
+		return Preset{}, false
+	}
+	return Preset{
+		Type:                 v.imageType,
+		Options:              v.config,
+		MaxAge:               v.maxAge,
+		StaleWhileRevalidate: v.staleWindow,
+		TTL:                  v.ttl,
+	}, true
+}
+
+// PresetStats returns the request statistics of a registered preset.
+func (c *Cache) PresetStats(name string) (PresetStats, bool) {
+	v, ok := c.preset(name)
+	if !ok {
+		return PresetStats{}, false
+	}
+	return PresetStats{
+		Hits:   v.stats.hits.Load(),
+		Misses: v.stats.misses.Load(),
+		Errors: v.stats.errors.Load(),
+	}, true
+}
+
+// HandlePreset creates a [Handler] that serves images with a registered
+// preset.
+func (c *Cache) HandlePreset(name string) (Handler, error) {
+	v, ok := c.preset(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown preset '%s'", name)
+	}
+	return func(name string, w http.ResponseWriter, r *http.Request) {
+		c.serve(v, name, w, r)
+	}, nil
+}
+
+// HandlePresets creates a [Handler] that serves all registered presets. The
+// name passed to the handler has the form <preset>/<name>. Requests for
+// unknown presets are answered with 404 Not Found.
+//
+//	h := imagecache.NewHTTPHandler(c.HandlePresets(), imagecache.PathValues("preset", "name"))
+//	mux.Handle("GET /{preset}/{name...}", h)
+func (c *Cache) HandlePresets() Handler {
+	return func(name string, w http.ResponseWriter, r *http.Request) {
+		preset, name, ok := strings.Cut(name, "/")
+		if !ok {
+			notFound(w)
+			return
+		}
+		v, ok := c.preset(preset)
+		if !ok {
+			notFound(w)
+			return
+		}
+		c.serve(v, name, w, r)
+	}
+}
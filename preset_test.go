@@ -0,0 +1,77 @@
+package imagecache
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPreset(t *testing.T) {
+	c, _ := newTestCache(t)
+	p := Preset{
+		Type:                 testVariant(t, c).imageType,
+		Options:              testOptions,
+		MaxAge:               time.Minute,
+		StaleWhileRevalidate: time.Second,
+		TTL:                  time.Hour,
+	}
+	if err := c.RegisterPreset("thumb", p); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RegisterPreset("thumb", p); !errors.Is(err, ErrPresetExists) {
+		t.Fatalf("expected ErrPresetExists, got %v", err)
+	}
+	got, ok := c.Preset("thumb")
+	if !ok || !reflect.DeepEqual(got, p) {
+		t.Fatalf("expected %+v, got %+v", p, got)
+	}
+}
+
+func TestHandlePresets(t *testing.T) {
+	c, _ := newTestCache(t)
+	imageType := testVariant(t, c).imageType
+	for _, name := range []string{"thumb", "small"} {
+		if err := c.RegisterPreset(name, Preset{Type: imageType, Options: testOptions}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	thumb, _ := c.preset("thumb")
+	small, _ := c.preset("small")
+	// same transformation, but cached on their own
+	if thumb.cacheKey("cat.png").String() == small.cacheKey("cat.png").String() {
+		t.Fatal("expected the preset name in the cache key")
+	}
+	seed(t, c, thumb, "cat.png", []byte("thumb"))
+	seed(t, c, small, "cat.png", []byte("small"))
+
+	h := c.HandlePresets()
+	for _, name := range []string{"thumb", "small"} {
+		if w := get(h, name+"/cat.png", nil); w.Code != http.StatusOK || w.Body.String() != name {
+			t.Errorf("expected %s variant, got %d %q", name, w.Code, w.Body)
+		}
+	}
+	for _, name := range []string{"other/cat.png", "cat.png"} {
+		if w := get(h, name, nil); w.Code != http.StatusNotFound {
+			t.Errorf("expected 404 for %s, got %d", name, w.Code)
+		}
+	}
+	// the original does not exist
+	if w := get(h, "thumb/dog.png", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing original, got %d", w.Code)
+	}
+
+	if stats, _ := c.PresetStats("thumb"); stats != (PresetStats{Hits: 1, Misses: 1}) {
+		t.Errorf("expected 1 hit and 1 miss, got %+v", stats)
+	}
+	if stats, _ := c.PresetStats("small"); stats != (PresetStats{Hits: 1}) {
+		t.Errorf("expected 1 hit, got %+v", stats)
+	}
+	if _, ok := c.PresetStats("other"); ok {
+		t.Error("expected no stats for an unknown preset")
+	}
+	if names := c.Presets(); !reflect.DeepEqual(names, []string{"small", "thumb"}) {
+		t.Errorf("expected sorted preset names, got %v", names)
+	}
+}
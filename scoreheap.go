@@ -0,0 +1,137 @@
+package imagecache
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Observer is an optional interface of an [EvictionStrategy] that follows
+// the changes of the items of a [Layer], e.g. to keep its own order of the
+// items, so it does not have to look at all items on every eviction. Its
+// methods are called while the layer is locked, so they must not call
+// methods of the [Layer].
+type Observer interface {
+	// Observe is called when the item was put, read or restored.
+	Observe(i ItemInfo)
+	// Forget is called when the item left the layer, evicted is false if it
+	// was deleted.
+	Forget(i ItemInfo, evicted bool)
+}
+
+// scoredItem is an item ordered by a score of an [EvictionStrategy].
+type scoredItem struct {
+	name       string
+	size       int64
+	lastAccess time.Time
+	score      float64
+	index      int
+}
+
+// scoreHeap is a min-heap of items by their score, ties are broken by the
+// last access. It can be ranged in order without modifying it.
+type scoreHeap struct {
+	items  []*scoredItem
+	byName map[string]*scoredItem
+}
+
+func newScoreHeap() *scoreHeap {
+	return &scoreHeap{
+		byName: make(map[string]*scoredItem),
+	}
+}
+
+// set adds the item i with score or updates it.
+func (h *scoreHeap) set(i ItemInfo, score float64) {
+	if s, ok := h.byName[i.Name]; ok {
+		s.size, s.lastAccess, s.score = i.Size, i.LastAccess, score
+		heap.Fix(h, s.index)
+		return
+	}
+	s := &scoredItem{
+		name:       i.Name,
+		size:       i.Size,
+		lastAccess: i.LastAccess,
+		score:      score,
+	}
+	h.byName[i.Name] = s
+	heap.Push(h, s)
+}
+
+// remove the item name.
+func (h *scoreHeap) remove(name string) {
+	if s, ok := h.byName[name]; ok {
+		delete(h.byName, name)
+		heap.Remove(h, s.index)
+	}
+}
+
+// victims returns the items with the lowest score until they add up to
+// excessItems and excessSize. The last returned item is the one with the
+// highest score.
+func (h *scoreHeap) victims(excessItems int, excessSize int64) (victims []*scoredItem) {
+	h.Range(func(s *scoredItem) bool {
+		if excessItems <= 0 && excessSize <= 0 {
+			return false
+		}
+		victims = append(victims, s)
+		excessItems--
+		excessSize -= s.size
+		return true
+	})
+	return
+}
+
+func (h *scoreHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *scoreHeap) Less(a, b int) bool {
+	if h.items[a].score != h.items[b].score {
+		return h.items[a].score < h.items[b].score
+	}
+	return h.items[a].lastAccess.Before(h.items[b].lastAccess)
+}
+
+func (h *scoreHeap) Swap(a, b int) {
+	h.items[a], h.items[b] = h.items[b], h.items[a]
+	h.items[a].index = a
+	h.items[b].index = b
+}
+
+func (h *scoreHeap) Push(x any) {
+	s := x.(*scoredItem)
+	s.index = len(h.items)
+	h.items = append(h.items, s)
+}
+
+func (h *scoreHeap) Pop() any {
+	last := len(h.items) - 1
+	s := h.items[last]
+	h.items[last] = nil
+	h.items = h.items[:last]
+	s.index = -1
+	return s
+}
+
+// Range calls fn for the items in order until fn returns false. Only the
+// items passed to fn and their children in the heap are looked at.
+func (h *scoreHeap) Range(fn func(*scoredItem) bool) {
+	if len(h.items) == 0 {
+		return
+	}
+	next := &heapCursor{
+		h:       h,
+		indices: []int{0},
+	}
+	for next.Len() > 0 {
+		index := heap.Pop(next).(int)
+		if !fn(h.items[index]) {
+			return
+		}
+		for _, child := range []int{2*index + 1, 2*index + 2} {
+			if child < len(h.items) {
+				heap.Push(next, child)
+			}
+		}
+	}
+}
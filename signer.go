@@ -0,0 +1,124 @@
+package imagecache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidSignature is returned if a signed path was not signed by any of
+// the keys of a [Signer].
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// ErrSignatureExpired is returned if a signed path is past its expiry time.
+var ErrSignatureExpired = errors.New("signature expired")
+
+const expiresPrefix = "exp:"
+
+// Signer signs and verifies paths with HMAC-SHA256. Multiple keys allow
+// rotating them: paths are always signed with the first key, but verified
+// against all of them.
+type Signer struct {
+	keys [][]byte
+}
+
+// NewSigner creates a new [Signer]. The first key is used for signing, all
+// keys are accepted when verifying.
+func NewSigner(keys ...[]byte) (*Signer, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one key is required")
+	}
+	for i, key := range keys {
+		if len(key) == 0 {
+			return nil, fmt.Errorf("key %d is empty", i)
+		}
+	}
+	return &Signer{
+		keys: keys,
+	}, nil
+}
+
+func (s *Signer) mac(key []byte, path string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(path))
+	return mac.Sum(nil)
+}
+
+// Sign path and return the signed path in the form
+// <signature>/exp:<expiry>/<path>. If expires is not the zero time, the
+// signed path is only valid until then, otherwise the expiry is 0.
+func (s *Signer) Sign(path string, expires time.Time) string {
+	var unix int64
+	if !expires.IsZero() {
+		unix = expires.Unix()
+	}
+	path = fmt.Sprintf("%s%d/%s", expiresPrefix, unix, strings.TrimPrefix(path, "/"))
+	signature := base64.RawURLEncoding.EncodeToString(s.mac(s.keys[0], path))
+	return signature + "/" + path
+}
+
+// SignParams signs the path for the image name transformed with p. The
+// result can be served by a handler created with [Cache.HandleSigned].
+func (s *Signer) SignParams(p Params, name string, expires time.Time) string {
+	return s.Sign(p.Path(name), expires)
+}
+
+// Verify the signature of a path created by [Signer.Sign] at the time now.
+// Returns the path without signature and expiry time. Returns
+// [ErrInvalidSignature] or [ErrSignatureExpired] if the path can't be used.
+func (s *Signer) Verify(signed string, now time.Time) (string, error) {
+	signature, path, ok := strings.Cut(strings.TrimPrefix(signed, "/"), "/")
+	if !ok {
+		return "", ErrInvalidSignature
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+
+	valid := false
+	for _, key := range s.keys {
+		if hmac.Equal(decoded, s.mac(key, path)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return "", ErrInvalidSignature
+	}
+
+	expires, rest, ok := strings.Cut(path, "/")
+	if !ok || !strings.HasPrefix(expires, expiresPrefix) {
+		return "", ErrInvalidSignature
+	}
+	unix, err := strconv.ParseInt(strings.TrimPrefix(expires, expiresPrefix), 10, 64)
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+	if unix != 0 && now.After(time.Unix(unix, 0)) {
+		return "", ErrSignatureExpired
+	}
+	return rest, nil
+}
+
+// HandleSigned creates a [Handler] like [Cache.HandleParams], that only
+// serves paths signed by signer. The signature is verified before the
+// [Storer] or libvips are involved, requests with an invalid or expired
+// signature are answered with 403 Forbidden. As the query is not covered by
+// the signature, all parameters have to be part of the path.
+func (c *Cache) HandleSigned(signer *Signer, limits ParamLimits) Handler {
+	return func(name string, w http.ResponseWriter, r *http.Request) {
+		path, err := signer.Verify(name, time.Now())
+		if err != nil {
+			forbidden(w)
+			return
+		}
+		c.serveParams(path, nil, limits, w, r)
+	}
+}
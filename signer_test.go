@@ -0,0 +1,83 @@
+package imagecache
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/h2non/bimg"
+)
+
+func TestSigner(t *testing.T) {
+	old, _ := NewSigner([]byte("old"))
+	signer, err := NewSigner([]byte("new"), []byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	p := Params{Width: 300, Height: 200, Type: bimg.WEBP}
+
+	signed := signer.SignParams(p, "photos/cat.jpg", time.Time{})
+	if path, err := signer.Verify(signed, now); err != nil || path != p.Path("photos/cat.jpg") {
+		t.Fatalf("verify failed: %q, %v", path, err)
+	}
+
+	// paths signed with a rotated key are still valid
+	if _, err := signer.Verify(old.Sign("cat.jpg", time.Time{}), now); err != nil {
+		t.Fatalf("expected old key to be accepted, got %v", err)
+	}
+
+	// names that look like an expiry are not mistaken for one
+	if path, err := signer.Verify(signer.Sign("exp:1/cat.jpg", time.Time{}), now); err != nil || path != "exp:1/cat.jpg" {
+		t.Fatalf("verify failed: %q, %v", path, err)
+	}
+
+	expiring := signer.Sign("cat.jpg", now.Add(time.Minute))
+	if path, err := signer.Verify(expiring, now); err != nil || path != "cat.jpg" {
+		t.Fatalf("verify failed: %q, %v", path, err)
+	}
+	if _, err := signer.Verify(expiring, now.Add(time.Hour)); !errors.Is(err, ErrSignatureExpired) {
+		t.Fatalf("expected expired signature, got %v", err)
+	}
+
+	for _, tampered := range []string{
+		signed + "x",
+		"cat.jpg",
+		"/" + signed[1:],
+		signed[:len(signed)-len("cat.jpg")] + "dog.jpg",
+	} {
+		if _, err := signer.Verify(tampered, now); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("expected %q to be rejected, got %v", tampered, err)
+		}
+	}
+}
+
+func TestHandleSigned(t *testing.T) {
+	store := &countingStore{Memory: NewMemory()}
+	c := NewWithOptions(store, []*Layer{NewLayer(NewMemory())})
+	signer, _ := NewSigner([]byte("key"))
+	h := c.HandleSigned(signer, DefaultParamLimits())
+	signed := signer.SignParams(Params{Width: 300, Type: bimg.JPEG}, "cat.jpg", time.Time{})
+
+	for _, name := range []string{
+		signed[:len(signed)-len("cat.jpg")] + "dog.jpg",
+		"unsigned/cat.jpg",
+		signer.Sign("w:300/cat.jpg", time.Now().Add(-time.Minute)),
+	} {
+		if w := get(h, name, nil); w.Code != http.StatusForbidden {
+			t.Errorf("expected 403 for %q, got %d", name, w.Code)
+		}
+	}
+	if lookups, reads := store.lookups.Load(), store.reads.Load(); lookups != 0 || reads != 0 {
+		t.Fatalf("expected the store not to be touched, got %d lookups and %d reads", lookups, reads)
+	}
+
+	// the original does not exist
+	if w := get(h, signed, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a valid signature, got %d", w.Code)
+	}
+	if store.lookups.Load()+store.reads.Load() == 0 {
+		t.Fatal("expected the store to be asked for a valid signature")
+	}
+}
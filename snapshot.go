@@ -0,0 +1,142 @@
+package imagecache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// snapshotVersion is the version of the snapshot format.
+const snapshotVersion = 1
+
+// snapshot is the persisted state of a [Layer].
+type snapshot struct {
+	Version int            `json:"version"`
+	Items   []snapshotItem `json:"items"`
+}
+
+// snapshotItem is a single item of a snapshot. Items are ordered from the
+// last to the next item to evict.
+type snapshotItem struct {
+	Name       string        `json:"name"`
+	Size       int64         `json:"size"`
+	Created    time.Time     `json:"created"`
+	LastAccess time.Time     `json:"lastAccess"`
+	Expires    time.Time     `json:"expires"`
+	Cost       time.Duration `json:"cost"`
+	Hits       uint64        `json:"hits"`
+}
+
+// SaveSnapshot writes the information about all items of the layer, in the
+// order of the [ReplacementPolicy] of the layer, to path. The file is
+// replaced atomically.
+func (l *Layer) SaveSnapshot(path string) error {
+	l.lock.RLock()
+	s := snapshot{
+		Version: snapshotVersion,
+		Items:   make([]snapshotItem, 0, len(l.inventory)),
+	}
+	l.policy.Range(func(name string) bool {
+		i, ok := l.inventory[name]
+		if !ok {
+			return true
+		}
+		s.Items = append(s.Items, snapshotItem{
+			Name:       i.name,
+			Size:       i.size,
+			Created:    i.created,
+			LastAccess: i.lastAccess,
+			Expires:    i.expires,
+			Cost:       i.cost,
+			Hits:       i.hits,
+		})
+		return true
+	})
+	l.lock.RUnlock()
+	// most valuable items first
+	slices.Reverse(s.Items)
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) //nolint:errcheck
+
+	if err := json.NewEncoder(f).Encode(s); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadSnapshot restores the information about items from a snapshot written
+// by [Layer.SaveSnapshot]. Items that no longer exist in the underlying cache
+// are skipped. Items accessed before are kept as they are, restored items are
+// evicted before them.
+func (l *Layer) LoadSnapshot(ctx context.Context, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var s snapshot
+	if err := json.NewDecoder(f).Decode(&s); err != nil {
+		return err
+	}
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+
+	items := make([]snapshotItem, 0, len(s.Items))
+	for _, si := range s.Items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if l.cache.Exists(ctx, si.Name) {
+			items = append(items, si)
+		}
+	}
+
+	names := make([]string, 0, len(items))
+	l.lock.Lock()
+	for _, si := range items {
+		restored := l.restore(&item{
+			name:       si.Name,
+			created:    si.Created,
+			lastAccess: si.LastAccess,
+			expires:    si.Expires,
+			cost:       si.Cost,
+			size:       si.Size,
+			hits:       si.Hits,
+		})
+		if restored {
+			names = append(names, si.Name)
+		}
+	}
+	l.lock.Unlock()
+	l.restored(names)
+	return nil
+}
+
+// BackgroundSnapshot saves a snapshot of the layer to path every dur. This
+// function blocks and stop it provide a Context that can be canceled.
+func (l *Layer) BackgroundSnapshot(ctx context.Context, path string, dur time.Duration) {
+	ticker := time.NewTicker(dur)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.SaveSnapshot(path) //nolint:errcheck
+		}
+	}
+}
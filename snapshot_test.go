@@ -0,0 +1,67 @@
+package imagecache
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestLayerSnapshot(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "layer.json")
+	mem := NewMemory()
+	l := NewLayer(mem)
+	for _, name := range []string{"a", "b", "c"} {
+		if err := l.Put(ctx, name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// b disappeared while the process was down
+	mem.Delete(ctx, "b") //nolint:errcheck
+	restored := NewLayer(mem)
+	if err := restored.LoadSnapshot(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+	if stats := restored.Stats(); stats.Count != 2 || stats.Size != 2 {
+		t.Fatalf("expected 2 items with 2 bytes, got %+v", stats)
+	}
+	if oldest, _ := (layerView{l: restored}).Oldest(); oldest.Name != "a" {
+		t.Fatalf("expected a to be the least recently accessed item, got %s", oldest.Name)
+	}
+}
+
+// unknownPolicy is a [ReplacementPolicy] that knows more items than the layer.
+type unknownPolicy struct {
+	*LRUPolicy
+}
+
+func (p unknownPolicy) Range(fn func(name string) bool) {
+	if fn("unknown") {
+		p.LRUPolicy.Range(fn)
+	}
+}
+
+func TestLayerSnapshotUnknownItems(t *testing.T) {
+	ctx := context.Background()
+	l := NewLayerWithPolicy(NewMemory(), unknownPolicy{NewLRUPolicy()})
+	l.Put(ctx, "a", []byte("a")) //nolint:errcheck
+	l.Wait(ctx)                  //nolint:errcheck
+	path := filepath.Join(t.TempDir(), "layer.json")
+	if err := l.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewLayer(l.cache)
+	if err := restored.LoadSnapshot(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+	if stats := restored.Stats(); stats.Count != 1 {
+		t.Fatalf("expected 1 item, got %+v", stats)
+	}
+}
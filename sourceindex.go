@@ -0,0 +1,58 @@
+package imagecache
+
+import "sync"
+
+// sourceIndex keeps track of all cached variants of an original image.
+type sourceIndex struct {
+	lock     sync.Mutex
+	variants map[string]map[string]struct{}
+	sources  map[string]string
+}
+
+func newSourceIndex() *sourceIndex {
+	return &sourceIndex{
+		variants: make(map[string]map[string]struct{}),
+		sources:  make(map[string]string),
+	}
+}
+
+// add records that cacheName is a variant of source.
+func (si *sourceIndex) add(source, cacheName string) {
+	si.lock.Lock()
+	defer si.lock.Unlock()
+	variants, ok := si.variants[source]
+	if !ok {
+		variants = make(map[string]struct{})
+		si.variants[source] = variants
+	}
+	variants[cacheName] = struct{}{}
+	si.sources[cacheName] = source
+}
+
+// remove forgets the single variant cacheName.
+func (si *sourceIndex) remove(cacheName string) {
+	si.lock.Lock()
+	defer si.lock.Unlock()
+	source, ok := si.sources[cacheName]
+	if !ok {
+		return
+	}
+	delete(si.sources, cacheName)
+	delete(si.variants[source], cacheName)
+	if len(si.variants[source]) == 0 {
+		delete(si.variants, source)
+	}
+}
+
+// take returns and forgets all known variants of source.
+func (si *sourceIndex) take(source string) []string {
+	si.lock.Lock()
+	defer si.lock.Unlock()
+	variants := make([]string, 0, len(si.variants[source]))
+	for cacheName := range si.variants[source] {
+		variants = append(variants, cacheName)
+		delete(si.sources, cacheName)
+	}
+	delete(si.variants, source)
+	return variants
+}
@@ -0,0 +1,158 @@
+package imagecache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// generation is the latest cached variant of an original.
+type generation struct {
+	cacheName string
+	created   time.Time
+	// refreshing is set while a newer generation is created in the
+	// background
+	refreshing bool
+}
+
+// generations keeps track of the latest variants of originals for variants
+// that can become stale. Generations are dropped when their variant leaves
+// the layers, so only variants in the layers are tracked.
+type generations struct {
+	lock   sync.RWMutex
+	latest map[string]map[string]generation
+}
+
+func newGenerations() *generations {
+	return &generations{
+		latest: make(map[string]map[string]generation),
+	}
+}
+
+func (g *generations) get(variantKey, name string) (generation, bool) {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	gen, ok := g.latest[name][variantKey]
+	return gen, ok
+}
+
+func (g *generations) set(variantKey, name, cacheName string, created time.Time) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	variants, ok := g.latest[name]
+	if !ok {
+		variants = make(map[string]generation)
+		g.latest[name] = variants
+	}
+	variants[variantKey] = generation{
+		cacheName: cacheName,
+		created:   created,
+	}
+}
+
+// refresh marks the generation gen of a variant of the original name as
+// being refreshed. Returns false if it is not the latest generation anymore
+// or a refresh is running already.
+func (g *generations) refresh(variantKey, name string, gen generation) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	current, ok := g.latest[name][variantKey]
+	if !ok || current.refreshing || current.cacheName != gen.cacheName || !current.created.Equal(gen.created) {
+		return false
+	}
+	current.refreshing = true
+	g.latest[name][variantKey] = current
+	return true
+}
+
+// refreshFailed allows another refresh of the generation gen.
+func (g *generations) refreshFailed(variantKey, name string, gen generation) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	current, ok := g.latest[name][variantKey]
+	if !ok || current.cacheName != gen.cacheName || !current.created.Equal(gen.created) {
+		return
+	}
+	current.refreshing = false
+	g.latest[name][variantKey] = current
+}
+
+// drop the generation of a variant of the original name, if it is
+// cacheName.
+func (g *generations) drop(variantKey, name, cacheName string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	variants, ok := g.latest[name]
+	if !ok || variants[variantKey].cacheName != cacheName {
+		return
+	}
+	delete(variants, variantKey)
+	if len(variants) == 0 {
+		delete(g.latest, name)
+	}
+}
+
+// forget all generations of the original name.
+func (g *generations) forget(name string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	delete(g.latest, name)
+}
+
+// stale checks if the latest generation of a variant has to be replaced by
+// the generation cacheName. modTime is the time the original was modified.
+// Returns the generation that can still be served while the variant is
+// refreshed in the background, and if the variant has to be refreshed at all.
+func (c *Cache) stale(v *variant, name, cacheName string, modTime time.Time) (gen generation, serveStale, refresh bool) {
+	if v.maxAge <= 0 && v.staleWindow <= 0 {
+		return generation{}, false, false
+	}
+	gen, ok := c.generations.get(v.id(), name)
+	if !ok {
+		return generation{}, false, false
+	}
+	now := time.Now()
+
+	if gen.cacheName != cacheName {
+		// the original has changed
+		changedRecently := modTime.IsZero() || now.Sub(modTime) <= v.staleWindow
+		return gen, v.staleWindow > 0 && changedRecently, false
+	}
+
+	age := now.Sub(gen.created)
+	if v.maxAge <= 0 || age <= v.maxAge {
+		return gen, false, false
+	}
+	return gen, age <= v.maxAge+v.staleWindow, true
+}
+
+// serveStale answers r with the outdated generation gen of a variant, if it
+// is still in one of the layers, and refreshes the variant in the
+// background. Only the first request for a generation starts a refresh.
+// Returns false if nothing was written.
+func (c *Cache) serveStale(v *variant, name string, key Key, gen generation, w http.ResponseWriter, r *http.Request) bool {
+	ctx := r.Context()
+	entry, layer, ok := c.lookup(ctx, name, gen.cacheName)
+	if !ok {
+		return false
+	}
+	if c.generations.refresh(v.id(), name, gen) {
+		c.active.Add(1)
+		go func() {
+			defer c.active.Done()
+			_, err := c.create(context.WithoutCancel(ctx), v, key)
+			if err != nil {
+				c.generations.refreshFailed(v.id(), name, gen)
+			}
+		}()
+	}
+
+	v.stats.hits.Add(1)
+	w.Header().Set("Age", fmt.Sprintf("%d", int64(time.Since(gen.created).Seconds())))
+	w.Header().Set("Warning", `110 - "Response is Stale"`)
+	writeEntry(w, r, gen.cacheName, entry, time.Time{})
+	c.promote(ctx, gen.cacheName, entry, layer)
+	return true
+}
@@ -0,0 +1,112 @@
+package imagecache
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newStaleCache creates a cache with a preset whose variants are outdated
+// after a minute and served stale for an hour.
+func newStaleCache(t *testing.T) (*Cache, *countingStore, *variant, Handler) {
+	store := &countingStore{Memory: NewMemory()}
+	c := NewWithOptions(store, []*Layer{NewLayer(NewMemory())}, WithVersionCheck(0, 0))
+	err := c.RegisterPreset("thumb", Preset{
+		Type:                 testVariant(t, c).imageType,
+		Options:              testOptions,
+		MaxAge:               time.Minute,
+		StaleWhileRevalidate: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _ := c.preset("thumb")
+	return c, store, v, func(name string, w http.ResponseWriter, r *http.Request) {
+		c.serve(v, name, w, r)
+	}
+}
+
+func TestServeStale(t *testing.T) {
+	ctx := context.Background()
+	c, store, v, h := newStaleCache(t)
+	cacheName := seedEntry(t, c, v, "cat.png", Entry{
+		Content:  []byte("stale"),
+		Metadata: Metadata{Created: time.Now().Add(-2 * time.Minute)},
+	})
+
+	for i := 0; i < 5; i++ {
+		w := get(h, "cat.png", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		if i == 0 {
+			// the first request learns the age of the variant
+			continue
+		}
+		if w.Body.String() != "stale" {
+			// refreshed already
+			continue
+		}
+		if age, _ := strconv.Atoi(w.Header().Get("Age")); age < 120 {
+			t.Errorf("expected Age of at least 120, got %q", w.Header().Get("Age"))
+		}
+		if w.Header().Get("Warning") == "" {
+			t.Error("expected Warning header")
+		}
+	}
+
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if reads := store.reads.Load(); reads != 1 {
+		t.Errorf("expected a single refresh, got %d", reads)
+	}
+	entry, err := c.layers[0].GetEntry(ctx, cacheName)
+	if err != nil || string(entry.Content) == "stale" {
+		t.Fatalf("expected refreshed variant, got %q, %v", entry.Content, err)
+	}
+	if time.Since(entry.Metadata.Created) > time.Minute {
+		t.Errorf("expected refreshed variant to be new, created %s", entry.Metadata.Created)
+	}
+}
+
+func TestServeStaleChangedSource(t *testing.T) {
+	ctx := context.Background()
+	c, store, v, h := newStaleCache(t)
+	old := seed(t, c, v, "cat.png", []byte("old"))
+	get(h, "cat.png", nil)
+
+	// the original changes without clearing its variants
+	store.Put(ctx, "cat.png", append(testImage(t), 0)) //nolint:errcheck
+	w := get(h, "cat.png", nil)
+	if w.Body.String() != "old" || w.Header().Get("Warning") == "" {
+		t.Fatalf("expected stale variant of the old original, got %q %v", w.Body, w.Header())
+	}
+
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	key := v.cacheKey("cat.png")
+	version, _ := store.Version(ctx, "cat.png")
+	key.Version = version.String()
+	if key.String() == old || !c.layers[0].Exists(ctx, key.String()) {
+		t.Fatal("expected variant of the new original to be cached")
+	}
+}
+
+func TestGenerationsDropped(t *testing.T) {
+	ctx := context.Background()
+	c, _, v, h := newStaleCache(t)
+	cacheName := seed(t, c, v, "cat.png", []byte("cat"))
+	get(h, "cat.png", nil)
+	if _, ok := c.generations.get(v.id(), "cat.png"); !ok {
+		t.Fatal("expected generation to be known")
+	}
+
+	c.Clear(ctx, cacheName)
+	if _, ok := c.generations.get(v.id(), "cat.png"); ok {
+		t.Fatal("expected generation to be dropped with its variant")
+	}
+}
@@ -1,9 +1,40 @@
 package imagecache
 
-import "context"
+import (
+	"context"
+	"fmt"
+	"time"
+)
 
 // Storer is the interface [Cache] expects to retrieve items from
 type Storer interface {
 	Exists(ctx context.Context, name string) bool
 	Get(ctx context.Context, name string) ([]byte, error)
 }
+
+// Versioner is an optional interface a [Storer] can implement to report the
+// version of an item. The version is part of the cache key of all variants,
+// so changed originals result in fresh variants.
+type Versioner interface {
+	Version(ctx context.Context, name string) (SourceVersion, error)
+}
+
+// SourceVersion identifies the revision of an original image. Not all
+// fields have to be known.
+type SourceVersion struct {
+	ModTime time.Time
+	Size    int64
+	ETag    string
+}
+
+// String returns a compact representation of the version that is used as
+// part of cache keys. If an ETag is known, it alone identifies the version.
+func (v SourceVersion) String() string {
+	if v.ETag != "" {
+		return v.ETag
+	}
+	if v.ModTime.IsZero() && v.Size == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%x.%x", v.ModTime.UnixNano(), v.Size)
+}
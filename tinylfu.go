@@ -0,0 +1,159 @@
+package imagecache
+
+import (
+	"hash/fnv"
+	"math/bits"
+	"sync"
+)
+
+// Admitter is an optional interface of an [EvictionStrategy] that decides
+// whether new items are put into a [Layer] at all.
+type Admitter interface {
+	// Record is called for every access to an item of the layer, including
+	// puts that are not admitted. It must be safe for concurrent use.
+	Record(name string)
+	// Admit decides if the new item name with size bytes is put into the
+	// layer. The layer is locked while Admit is called, so it must not call
+	// methods of the [Layer].
+	Admit(view LayerView, name string, size int64) bool
+}
+
+// compile time checks
+var _ EvictionStrategy = &TinyLFUEviction{}
+var _ Admitter = &TinyLFUEviction{}
+
+// sketchDepth is the number of rows of the count-min sketch.
+const sketchDepth = 4
+
+// sketchMax is the maximum value of a counter of the sketch.
+const sketchMax = 15
+
+// countMinSketch estimates the frequency of keys in little space. Counters
+// are halved periodically, so the frequency ages.
+type countMinSketch struct {
+	lock      sync.Mutex
+	rows      [sketchDepth][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+func newCountMinSketch(width int) *countMinSketch {
+	if width < 16 {
+		width = 16
+	}
+	// round up to a power of two, so indexes can be masked
+	width = 1 << bits.Len(uint(width-1))
+	s := &countMinSketch{
+		mask:    uint64(width - 1),
+		resetAt: width * 10,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *countMinSketch) indexes(key string) (idx [sketchDepth]uint64) {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	h := hash.Sum64()
+	h2 := h>>32 | 1
+	for i := range idx {
+		idx[i] = (h + uint64(i)*h2) & s.mask
+	}
+	return
+}
+
+func (s *countMinSketch) add(key string) {
+	idx := s.indexes(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, j := range idx {
+		if s.rows[i][j] < sketchMax {
+			s.rows[i][j]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.resetAt {
+		s.additions /= 2
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] /= 2
+			}
+		}
+	}
+}
+
+func (s *countMinSketch) estimate(key string) uint8 {
+	idx := s.indexes(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	min := uint8(sketchMax)
+	for i, j := range idx {
+		if s.rows[i][j] < min {
+			min = s.rows[i][j]
+		}
+	}
+	return min
+}
+
+// TinyLFUEviction evicts the least recently used items when a certain
+// number of items or a certain size is reached, like [MaxItemsEviction] and
+// [MaxCacheSizeEviction]. In the style of W-TinyLFU it also guards the layer
+// against items that are requested only once: while the layer is full, a new
+// item is only admitted if it was requested more often than the item that
+// would be evicted for it. Frequencies are estimated with a count-min sketch
+// that ages over time.
+type TinyLFUEviction struct {
+	maxItems int
+	maxSize  int64
+	sketch   *countMinSketch
+}
+
+// NewTinyLFUEviction creates a new EvictionStrategy which limits the layer
+// to maxItems items and maxSize bytes. 0 disables the respective limit. The
+// size of the frequency sketch is based on maxItems, or on a default
+// if maxItems is 0.
+func NewTinyLFUEviction(maxItems int, maxSize int64) *TinyLFUEviction {
+	width := maxItems
+	if width <= 0 {
+		width = 1 << 16
+	}
+	return &TinyLFUEviction{
+		maxItems: maxItems,
+		maxSize:  maxSize,
+		sketch:   newCountMinSketch(width),
+	}
+}
+
+func (t *TinyLFUEviction) Record(name string) {
+	t.sketch.add(name)
+}
+
+func (t *TinyLFUEviction) Admit(view LayerView, name string, size int64) bool {
+	roomForItem := t.maxItems <= 0 || int(view.Count()) < t.maxItems
+	roomForSize := t.maxSize <= 0 || view.Size()+size <= t.maxSize
+	if roomForItem && roomForSize {
+		return true
+	}
+	victim, ok := view.Oldest()
+	if !ok {
+		return true
+	}
+	return t.sketch.estimate(name) > t.sketch.estimate(victim.Name)
+}
+
+func (t *TinyLFUEviction) Victims(view LayerView) (victims []string) {
+	items, bytes := excess(view, t.maxItems, t.maxSize)
+	if items <= 0 && bytes <= 0 {
+		return nil
+	}
+	view.Range(func(i ItemInfo) bool {
+		victims = append(victims, i.Name)
+		items--
+		bytes -= i.Size
+		return items > 0 || bytes > 0
+	})
+	return
+}
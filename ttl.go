@@ -0,0 +1,187 @@
+package imagecache
+
+import (
+	"container/heap"
+	"time"
+)
+
+// TTLEviction evicts items a certain time after they were created, no matter
+// how often they are accessed. Items with an expiry time of their own, see
+// [Metadata.Expires], are evicted once it has passed instead.
+type TTLEviction struct {
+	ttl time.Duration
+}
+
+// NewTTLEviction creates a new EvictionStrategy which evicts items ttl after
+// their creation. With a ttl of 0 only items with an expiry time of their own
+// are evicted.
+func NewTTLEviction(ttl time.Duration) *TTLEviction {
+	return &TTLEviction{
+		ttl: ttl,
+	}
+}
+
+func (te *TTLEviction) Victims(view LayerView) (victims []string) {
+	now := time.Now()
+	view.RangeExpires(func(i ItemInfo) bool {
+		if i.Expires.After(now) {
+			return false
+		}
+		victims = append(victims, i.Name)
+		return true
+	})
+	if te.ttl <= 0 {
+		return
+	}
+	view.RangeCreated(func(i ItemInfo) bool {
+		if now.Sub(i.Created) <= te.ttl {
+			return false
+		}
+		victims = append(victims, i.Name)
+		return true
+	})
+	return
+}
+
+// itemHeap is a min-heap of items, which can be ranged in order without
+// modifying it. position returns the field of an item that holds its index
+// in the heap, items can only be in heaps using different fields at a time.
+type itemHeap struct {
+	items    []*item
+	less     func(a, b *item) bool
+	position func(i *item) *int
+}
+
+// expiryIndex is the position of an item in byCreated or byExpires.
+func expiryIndex(i *item) *int {
+	return &i.index
+}
+
+// byCreated orders items without an expiry time of their own.
+func byCreated(a, b *item) bool {
+	return a.created.Before(b.created)
+}
+
+// byExpires orders items with an expiry time of their own.
+func byExpires(a, b *item) bool {
+	return a.expires.Before(b.expires)
+}
+
+// byLastAccess orders all items from the least recently accessed one.
+func byLastAccess(a, b *item) bool {
+	return a.lastAccess.Before(b.lastAccess)
+}
+
+func newItemHeap(less func(a, b *item) bool, position func(i *item) *int) *itemHeap {
+	return &itemHeap{
+		less:     less,
+		position: position,
+	}
+}
+
+func (h *itemHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *itemHeap) Less(a, b int) bool {
+	return h.less(h.items[a], h.items[b])
+}
+
+func (h *itemHeap) Swap(a, b int) {
+	h.items[a], h.items[b] = h.items[b], h.items[a]
+	*h.position(h.items[a]) = a
+	*h.position(h.items[b]) = b
+}
+
+func (h *itemHeap) Push(x any) {
+	i := x.(*item)
+	*h.position(i) = len(h.items)
+	h.items = append(h.items, i)
+}
+
+func (h *itemHeap) Pop() any {
+	last := len(h.items) - 1
+	i := h.items[last]
+	h.items[last] = nil
+	h.items = h.items[:last]
+	*h.position(i) = -1
+	return i
+}
+
+// add i to the heap.
+func (h *itemHeap) add(i *item) {
+	heap.Push(h, i)
+}
+
+// contains reports if i is in the heap.
+func (h *itemHeap) contains(i *item) bool {
+	index := *h.position(i)
+	return index >= 0 && index < len(h.items) && h.items[index] == i
+}
+
+// remove i from the heap.
+func (h *itemHeap) remove(i *item) {
+	if h.contains(i) {
+		heap.Remove(h, *h.position(i))
+	}
+}
+
+// fix the position of i after the field it is ordered by changed.
+func (h *itemHeap) fix(i *item) {
+	if h.contains(i) {
+		heap.Fix(h, *h.position(i))
+	}
+}
+
+// Range calls fn for the items in order until fn returns false. Only the
+// items passed to fn and their children in the heap are looked at.
+func (h *itemHeap) Range(fn func(*item) bool) {
+	if len(h.items) == 0 {
+		return
+	}
+	next := &heapCursor{
+		h:       h,
+		indices: []int{0},
+	}
+	for next.Len() > 0 {
+		index := heap.Pop(next).(int)
+		if !fn(h.items[index]) {
+			return
+		}
+		for _, child := range []int{2*index + 1, 2*index + 2} {
+			if child < len(h.items) {
+				heap.Push(next, child)
+			}
+		}
+	}
+}
+
+// heapCursor holds the indices of the next candidates while ranging a
+// heap, like [itemHeap].
+type heapCursor struct {
+	h       interface{ Less(a, b int) bool }
+	indices []int
+}
+
+func (hc *heapCursor) Len() int {
+	return len(hc.indices)
+}
+
+func (hc *heapCursor) Less(a, b int) bool {
+	return hc.h.Less(hc.indices[a], hc.indices[b])
+}
+
+func (hc *heapCursor) Swap(a, b int) {
+	hc.indices[a], hc.indices[b] = hc.indices[b], hc.indices[a]
+}
+
+func (hc *heapCursor) Push(x any) {
+	hc.indices = append(hc.indices, x.(int))
+}
+
+func (hc *heapCursor) Pop() any {
+	last := len(hc.indices) - 1
+	index := hc.indices[last]
+	hc.indices = hc.indices[:last]
+	return index
+}
@@ -1,10 +1,14 @@
 package imagecache
 
 import (
+	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/base64"
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/h2non/bimg"
 )
@@ -22,10 +26,25 @@ func handleImage(content []byte, option bimg.Options, imageType bimg.ImageType)
 	return image.Image(), nil
 }
 
-func cacheKey(config bimg.Options) string {
-	hash := md5.New()
-	hash.Write([]byte(fmt.Sprintf("%+v", config)))
-	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil))
+// wait blocks until wg is done or ctx is done. Returns the error of ctx in
+// the latter case.
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func serviceUnavailable(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain")
+	http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
 }
 
 func internalError(w http.ResponseWriter) {
@@ -33,12 +52,57 @@ func internalError(w http.ResponseWriter) {
 	http.Error(w, "Internal error", http.StatusInternalServerError)
 }
 
+func forbidden(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain")
+	http.Error(w, "Forbidden", http.StatusForbidden)
+}
+
 func notFound(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "text/plain")
 	http.Error(w, "Not found", http.StatusNotFound)
 }
 
-func writeImage(w http.ResponseWriter, content []byte) {
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(content)))
-	w.Write(content) //nolint:errcheck
+func badRequest(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain")
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+func methodNotAllowed(w http.ResponseWriter) {
+	w.Header().Set("Allow", "GET, HEAD")
+	w.Header().Set("Content-Type", "text/plain")
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
+
+func notAcceptable(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain")
+	http.Error(w, "Not acceptable", http.StatusNotAcceptable)
+}
+
+// etag calculates a strong entity tag for the content of a cached variant.
+func etag(cacheName string, content []byte) string {
+	hash := md5.New()
+	hash.Write([]byte(cacheName))
+	hash.Write(content)
+	return fmt.Sprintf(`"%s"`, base64.RawURLEncoding.EncodeToString(hash.Sum(nil)))
+}
+
+// writeEntry writes the content of entry as the response to r, like
+// [writeImage]. The metadata of the entry is used if it is more precise.
+// If modTime is zero, the creation time of the entry is used.
+func writeEntry(w http.ResponseWriter, r *http.Request, cacheName string, entry Entry, modTime time.Time) {
+	if entry.Metadata.ContentType != "" {
+		w.Header().Set("Content-Type", entry.Metadata.ContentType)
+	}
+	if modTime.IsZero() {
+		modTime = entry.Metadata.Created
+	}
+	writeImage(w, r, cacheName, entry.Content, modTime)
+}
+
+// writeImage writes content as the response to r. Conditional requests are
+// answered with 304 Not Modified if the ETag or modTime match. A zero modTime
+// means the time of the last modification is unknown.
+func writeImage(w http.ResponseWriter, r *http.Request, cacheName string, content []byte, modTime time.Time) {
+	w.Header().Set("ETag", etag(cacheName, content))
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(content))
 }
@@ -0,0 +1,22 @@
+package imagecache
+
+import "context"
+
+// version returns the version of the original name, if the [Storer] is a
+// [Versioner]. Versions are remembered as configured by [WithVersionCheck],
+// so cache hits don't have to ask the [Storer] every time.
+func (c *Cache) version(ctx context.Context, name string) (SourceVersion, bool) {
+	if version, ok := c.versions.get(name); ok {
+		return version, true
+	}
+	versioner, ok := c.store.(Versioner)
+	if !ok {
+		return SourceVersion{}, false
+	}
+	version, err := versioner.Version(ctx, name)
+	if err != nil {
+		return SourceVersion{}, false
+	}
+	c.versions.add(name, version)
+	return version, true
+}
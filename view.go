@@ -0,0 +1,118 @@
+package imagecache
+
+import "time"
+
+// ItemInfo describes an item of a [Layer].
+type ItemInfo struct {
+	Name string
+	// Size of the item in bytes.
+	Size int64
+	// Created is the time the item was created, see [Metadata.Created], or
+	// the time it was put into the layer if unknown.
+	Created time.Time
+	// LastAccess is the time the item was put or read the last time.
+	LastAccess time.Time
+	// Expires is the expiry time of the item, see [Metadata.Expires].
+	Expires time.Time
+	// Cost is the time it took to create the item, see [Metadata.Cost].
+	Cost time.Duration
+	// Hits is the number of times the item was put or read.
+	Hits uint64
+}
+
+// LayerView is a read-only view of the state of a [Layer], given to an
+// [EvictionStrategy]. It must not be used after the strategy returned.
+type LayerView interface {
+	// Count is the number of items in the layer.
+	Count() int32
+	// Size is the size of all items in the layer in bytes.
+	Size() int64
+	// Oldest returns the item that is evicted next according to the
+	// [ReplacementPolicy] of the layer, the least recently accessed one
+	// for the default [LRUPolicy]. Returns false if the layer is empty.
+	Oldest() (ItemInfo, bool)
+	// Item returns the item name. Returns false if it does not exist.
+	Item(name string) (ItemInfo, bool)
+	// Range calls fn for all items in the order of the [ReplacementPolicy]
+	// of the layer, starting with the next item to evict, until fn returns
+	// false.
+	Range(fn func(ItemInfo) bool)
+	// RangeLastAccess calls fn for all items, from the least recently
+	// accessed to the most recently accessed one, until fn returns false.
+	RangeLastAccess(fn func(ItemInfo) bool)
+	// RangeCreated calls fn for all items without an expiry time, from the
+	// oldest to the newest one, until fn returns false.
+	RangeCreated(fn func(ItemInfo) bool)
+	// RangeExpires calls fn for all items with an expiry time, from the
+	// earliest to the latest one, until fn returns false.
+	RangeExpires(fn func(ItemInfo) bool)
+}
+
+// layerView implements [LayerView] for a layer that is locked for reading.
+type layerView struct {
+	l *Layer
+}
+
+func (i *item) info() ItemInfo {
+	return ItemInfo{
+		Name:       i.name,
+		Size:       i.size,
+		Created:    i.created,
+		LastAccess: i.lastAccess,
+		Expires:    i.expires,
+		Cost:       i.cost,
+		Hits:       i.hits,
+	}
+}
+
+func (lv layerView) Count() int32 {
+	return lv.l.count.Load()
+}
+
+func (lv layerView) Size() int64 {
+	return lv.l.size.Load()
+}
+
+func (lv layerView) Oldest() (oldest ItemInfo, ok bool) {
+	lv.Range(func(i ItemInfo) bool {
+		oldest, ok = i, true
+		return false
+	})
+	return
+}
+
+func (lv layerView) Item(name string) (ItemInfo, bool) {
+	i, ok := lv.l.inventory[name]
+	if !ok {
+		return ItemInfo{}, false
+	}
+	return i.info(), true
+}
+
+func (lv layerView) Range(fn func(ItemInfo) bool) {
+	lv.l.policy.Range(func(name string) bool {
+		i, ok := lv.l.inventory[name]
+		if !ok {
+			return true
+		}
+		return fn(i.info())
+	})
+}
+
+func (lv layerView) RangeLastAccess(fn func(ItemInfo) bool) {
+	lv.l.byLastAccess.Range(func(i *item) bool {
+		return fn(i.info())
+	})
+}
+
+func (lv layerView) RangeCreated(fn func(ItemInfo) bool) {
+	lv.l.byCreated.Range(func(i *item) bool {
+		return fn(i.info())
+	})
+}
+
+func (lv layerView) RangeExpires(fn func(ItemInfo) bool) {
+	lv.l.byExpires.Range(func(i *item) bool {
+		return fn(i.info())
+	})
+}
@@ -0,0 +1,219 @@
+package imagecache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WriteBackPolicy decides what happens to a write when the write-back queue
+// is full.
+type WriteBackPolicy int
+
+const (
+	// DropWhenFull drops the write, the variant is created again on the
+	// next request.
+	DropWhenFull WriteBackPolicy = iota
+	// BlockWhenFull waits until there is space in the queue, at most for
+	// the Timeout of the [WriteBackConfig]. Requests are answered before
+	// waiting, so only the write is delayed.
+	BlockWhenFull
+)
+
+// WriteBackConfig configures how variants are written to the layers in the
+// background.
+type WriteBackConfig struct {
+	// Workers is the number of concurrent writers.
+	Workers int
+	// QueueSize is the number of writes that can be pending.
+	QueueSize int
+	// Timeout for writing a variant to all layers, and for waiting for space
+	// in the queue with [BlockWhenFull]. The timeout is independent of the
+	// request the variant was created for.
+	Timeout time.Duration
+	Policy  WriteBackPolicy
+}
+
+// DefaultWriteBackConfig returns the configuration that is used if no other
+// is set with [WithWriteBack].
+func DefaultWriteBackConfig() WriteBackConfig {
+	return WriteBackConfig{
+		Workers:   4,
+		QueueSize: 256,
+		Timeout:   30 * time.Second,
+		Policy:    DropWhenFull,
+	}
+}
+
+// WriteBackStats contains information about the writes to the layers
+//   - Written: writes that succeeded in all layers
+//   - Failed: writes that failed in at least one layer
+//   - Refused: writes that were not admitted by at least one layer, see
+//     [ErrNotAdmitted], but did not fail
+//   - Dropped: writes that never happened because the queue was full
+//   - Pending: writes waiting in the queue
+type WriteBackStats struct {
+	Written uint64
+	Failed  uint64
+	Refused uint64
+	Dropped uint64
+	Pending int
+}
+
+// writeJob puts entry as name into all layers above the given index.
+type writeJob struct {
+	name  string
+	entry Entry
+	above int
+}
+
+// writeBack is a bounded queue of writes to the layers, processed by a
+// fixed number of workers.
+type writeBack struct {
+	layers []*Layer
+	config WriteBackConfig
+	jobs   chan writeJob
+	wg     sync.WaitGroup
+	// start starts the workers with the first write
+	start  sync.Once
+	lock   sync.RWMutex
+	closed bool
+	// discarded is called with the name of every write that was not stored
+	// in any layer
+	discarded func(name string)
+	written   atomic.Uint64
+	failed    atomic.Uint64
+	refused   atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+func newWriteBack(layers []*Layer, config WriteBackConfig, discarded func(name string)) *writeBack {
+	defaults := DefaultWriteBackConfig()
+	if config.Workers <= 0 {
+		config.Workers = defaults.Workers
+	}
+	if config.QueueSize < 0 {
+		config.QueueSize = 0
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaults.Timeout
+	}
+	return &writeBack{
+		layers:    layers,
+		config:    config,
+		jobs:      make(chan writeJob, config.QueueSize),
+		discarded: discarded,
+	}
+}
+
+// startWorkers starts the workers, which run until the queue is closed.
+func (wb *writeBack) startWorkers() {
+	wb.wg.Add(wb.config.Workers)
+	for i := 0; i < wb.config.Workers; i++ {
+		go wb.work()
+	}
+}
+
+func (wb *writeBack) work() {
+	defer wb.wg.Done()
+	for job := range wb.jobs {
+		wb.write(job)
+	}
+}
+
+func (wb *writeBack) write(job writeJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), wb.config.Timeout)
+	defer cancel()
+
+	failed, refused, stored := false, false, false
+	for i := 0; i < job.above; i++ {
+		err := wb.layers[i].PutEntry(ctx, job.name, job.entry)
+		switch {
+		case err == nil:
+			stored = true
+		case errors.Is(err, ErrNotAdmitted):
+			refused = true
+		default:
+			failed = true
+		}
+	}
+	switch {
+	case failed:
+		wb.failed.Add(1)
+	case refused:
+		wb.refused.Add(1)
+	default:
+		wb.written.Add(1)
+	}
+	if !stored {
+		wb.discard(job)
+	}
+}
+
+// discard a write that was not stored in any layer.
+func (wb *writeBack) discard(job writeJob) {
+	if wb.discarded != nil {
+		wb.discarded(job.name)
+	}
+}
+
+// enqueue a write according to the policy. ctx is only used to stop waiting
+// for space in the queue.
+func (wb *writeBack) enqueue(ctx context.Context, job writeJob) {
+	if !wb.push(ctx, job) {
+		wb.dropped.Add(1)
+		wb.discard(job)
+	}
+}
+
+// push job into the queue. Returns false if the job was dropped.
+func (wb *writeBack) push(ctx context.Context, job writeJob) bool {
+	wb.lock.RLock()
+	defer wb.lock.RUnlock()
+	if wb.closed {
+		return false
+	}
+	wb.start.Do(wb.startWorkers)
+	if wb.config.Policy == BlockWhenFull {
+		timeout := time.NewTimer(wb.config.Timeout)
+		defer timeout.Stop()
+		select {
+		case wb.jobs <- job:
+			return true
+		case <-ctx.Done():
+			return false
+		case <-timeout.C:
+			return false
+		}
+	}
+	select {
+	case wb.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops accepting writes and waits until all pending writes are done
+// or ctx is done.
+func (wb *writeBack) close(ctx context.Context) error {
+	wb.lock.Lock()
+	if !wb.closed {
+		wb.closed = true
+		close(wb.jobs)
+	}
+	wb.lock.Unlock()
+	return wait(ctx, &wb.wg)
+}
+
+func (wb *writeBack) stats() WriteBackStats {
+	return WriteBackStats{
+		Written: wb.written.Load(),
+		Failed:  wb.failed.Load(),
+		Refused: wb.refused.Load(),
+		Dropped: wb.dropped.Load(),
+		Pending: len(wb.jobs),
+	}
+}
@@ -0,0 +1,209 @@
+package imagecache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingCacher is [Memory] with writes that wait until release is closed.
+type blockingCacher struct {
+	*Memory
+	started chan string
+	release chan struct{}
+}
+
+func newBlockingCacher() *blockingCacher {
+	return &blockingCacher{
+		Memory:  NewMemory(),
+		started: make(chan string, 16),
+		release: make(chan struct{}),
+	}
+}
+
+func (bc *blockingCacher) PutEntry(ctx context.Context, name string, entry Entry) error {
+	bc.started <- name
+	<-bc.release
+	return bc.Memory.PutEntry(ctx, name, entry)
+}
+
+// failingCacher is [Memory] that can't be written to.
+type failingCacher struct {
+	*Memory
+}
+
+func (fc *failingCacher) PutEntry(context.Context, string, Entry) error {
+	return errors.New("disk full")
+}
+
+// fullWriteBack returns a write-back queue with a single worker blocked by
+// the first write and a full queue.
+func fullWriteBack(t *testing.T, policy WriteBackPolicy) (*writeBack, *blockingCacher) {
+	bc := newBlockingCacher()
+	wb := newWriteBack([]*Layer{NewLayer(bc)}, WriteBackConfig{
+		Workers:   1,
+		QueueSize: 1,
+		Timeout:   50 * time.Millisecond,
+		Policy:    policy,
+	}, nil)
+	wb.enqueue(context.Background(), writeJob{name: "first", above: 1})
+	<-bc.started
+	wb.enqueue(context.Background(), writeJob{name: "queued", above: 1})
+	return wb, bc
+}
+
+func TestWriteBackDropWhenFull(t *testing.T) {
+	wb, bc := fullWriteBack(t, DropWhenFull)
+	wb.enqueue(context.Background(), writeJob{name: "dropped", above: 1})
+	if stats := wb.stats(); stats.Dropped != 1 || stats.Pending != 1 {
+		t.Fatalf("expected 1 dropped and 1 pending write, got %+v", stats)
+	}
+
+	close(bc.release)
+	if err := wb.close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if stats := wb.stats(); stats.Written != 2 || stats.Pending != 0 {
+		t.Fatalf("expected 2 written writes, got %+v", stats)
+	}
+}
+
+func TestWriteBackBlockWhenFull(t *testing.T) {
+	wb, bc := fullWriteBack(t, BlockWhenFull)
+
+	// gives up after the timeout
+	start := time.Now()
+	wb.enqueue(context.Background(), writeJob{name: "timeout", above: 1})
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("expected to wait for the timeout, waited %s", waited)
+	}
+	if stats := wb.stats(); stats.Dropped != 1 {
+		t.Fatalf("expected 1 dropped write, got %+v", stats)
+	}
+
+	// waits for space in the queue
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		wb.enqueue(context.Background(), writeJob{name: "blocked", above: 1})
+	}()
+	close(bc.release)
+	<-done
+	if err := wb.close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if stats := wb.stats(); stats.Written != 3 || stats.Dropped != 1 {
+		t.Fatalf("expected 3 written and 1 dropped write, got %+v", stats)
+	}
+}
+
+func TestWriteBackFailedAndRefused(t *testing.T) {
+	ctx := context.Background()
+	full := NewLayer(NewMemory(), NewTinyLFUEviction(1, 0))
+	full.Put(ctx, "popular", []byte{1}) //nolint:errcheck
+	full.Wait(ctx)                      //nolint:errcheck
+
+	var lock sync.Mutex
+	var discarded []string
+	wb := newWriteBack([]*Layer{full, NewLayer(&failingCacher{NewMemory()})}, DefaultWriteBackConfig(), func(name string) {
+		lock.Lock()
+		defer lock.Unlock()
+		discarded = append(discarded, name)
+	})
+	wb.enqueue(ctx, writeJob{name: "refused", entry: Entry{Content: []byte{1}}, above: 1})
+	wb.enqueue(ctx, writeJob{name: "failed", entry: Entry{Content: []byte{1}}, above: 2})
+	if err := wb.close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if stats := wb.stats(); stats.Refused != 1 || stats.Failed != 1 || stats.Written != 0 {
+		t.Fatalf("expected 1 refused and 1 failed write, got %+v", stats)
+	}
+	if fmt.Sprint(discarded) != "[refused failed]" && fmt.Sprint(discarded) != "[failed refused]" {
+		t.Fatalf("expected both writes to be discarded, got %v", discarded)
+	}
+}
+
+func TestBlockWhenFullAnswersRequests(t *testing.T) {
+	ctx := context.Background()
+	bc := newBlockingCacher()
+	store := NewMemory()
+	c := NewWithOptions(store, []*Layer{NewLayer(bc)}, WithWriteBack(WriteBackConfig{
+		Workers: 1,
+		Timeout: time.Second,
+		Policy:  BlockWhenFull,
+	}))
+	h, err := c.Handle(testVariant(t, c).imageType, testOptions)
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, name := range []string{"a.png", "b.png"} {
+		store.Put(ctx, name, testImage(t)) //nolint:errcheck
+	}
+
+	// the only worker is blocked by the first write, the queue has no space
+	if w := get(h, "a.png", nil); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	<-bc.started
+	answered := make(chan int)
+	go func() {
+		answered <- get(h, "b.png", nil).Code
+	}()
+	select {
+	case code := <-answered:
+		if code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", code)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("request was not answered while the write-back queue was full")
+	}
+
+	close(bc.release)
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlockWhenFullAnswersHits(t *testing.T) {
+	ctx := context.Background()
+	bc := newBlockingCacher()
+	c := NewWithOptions(NewMemory(), []*Layer{NewLayer(bc), NewLayer(NewMemory())}, WithWriteBack(WriteBackConfig{
+		Workers: 1,
+		Timeout: time.Second,
+		Policy:  BlockWhenFull,
+	}))
+	v := testVariant(t, c)
+	h := func(name string, w http.ResponseWriter, r *http.Request) {
+		c.serve(v, name, w, r)
+	}
+	c.store.(*Memory).Put(ctx, "a.png", testImage(t)) //nolint:errcheck
+	// b.png is only cached in the lower layer
+	seedLayer(t, c, 1, v, "b.png", Entry{Content: []byte("cached")})
+
+	// the only worker is blocked by the first write, the queue has no space
+	if w := get(h, "a.png", nil); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	<-bc.started
+	answered := make(chan string)
+	go func() {
+		answered <- get(h, "b.png", nil).Body.String()
+	}()
+	select {
+	case body := <-answered:
+		if body != "cached" {
+			t.Fatalf("expected the cached variant, got %q", body)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("cache hit was not answered while the write-back queue was full")
+	}
+
+	close(bc.release)
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+}